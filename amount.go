@@ -0,0 +1,74 @@
+package pgperf
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/shopspring/decimal"
+)
+
+// currencyScale is the number of decimal places each currency supports.
+var currencyScale = map[string]int32{
+	"IDRT": 2,
+	"PTU":  8,
+	"BTC":  8,
+	"ETH":  18,
+}
+
+// Amount validation errors.
+var (
+	ErrNegativeAmount  = errors.New("amount must be positive")
+	ErrTooManyDecimals = errors.New("amount has too many decimal places")
+)
+
+// maxAmountDigits is how many digits before the decimal point accounts.amount can hold.
+// The column is unconstrained numeric, so it is limited only by the numeric format itself.
+const maxAmountDigits = 131072
+
+// fitsAmount reports whether amt fits into accounts.amount column.
+// Counts digits instead of comparing with 10^maxAmountDigits, which is a huge number to build.
+func fitsAmount(amt decimal.Decimal) bool {
+	return amt.NumDigits()+int(amt.Exponent()) <= maxAmountDigits
+}
+
+// maxCurrencyScale is the largest scale of all currencies, so amounts with more decimal
+// places are invalid whatever the currency is.
+var maxCurrencyScale = func() int32 {
+	var max int32
+	for _, scale := range currencyScale {
+		if scale > max {
+			max = scale
+		}
+	}
+
+	return max
+}()
+
+// ValidateAmount checks that amount is positive and does not have more than scale decimal places.
+// Returns ErrNegativeAmount (for zero too) or ErrTooManyDecimals.
+func ValidateAmount(amt decimal.Decimal, scale int32) error {
+	if !amt.IsPositive() {
+		return fmt.Errorf("%w: got %v", ErrNegativeAmount, amt)
+	}
+
+	// Compare with truncated value, so trailing zeroes (1.500000) do not count.
+	if !amt.Equal(amt.Truncate(scale)) {
+		return fmt.Errorf("%w: %v has more than %d", ErrTooManyDecimals, amt, scale)
+	}
+
+	return nil
+}
+
+// ValidateAmountScale checks that amount is valid for currency (see ValidateAmount).
+func ValidateAmountScale(amt decimal.Decimal, currency string) error {
+	scale, ok := currencyScale[currency]
+	if !ok {
+		return fmt.Errorf("unknown currency %q", currency)
+	}
+
+	if err := ValidateAmount(amt, scale); err != nil {
+		return fmt.Errorf("invalid %s amount: %w", currency, err)
+	}
+
+	return nil
+}
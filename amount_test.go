@@ -0,0 +1,61 @@
+package pgperf_test
+
+import (
+	"errors"
+	"testing"
+
+	"pgperf"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestValidateAmountScale(t *testing.T) {
+	cases := []struct {
+		currency string
+		valid    string
+		invalid  string
+	}{
+		{"IDRT", "1000.50", "1000.505"},
+		{"PTU", "0.12345678", "0.123456789"},
+		{"BTC", "0.00000001", "0.000000001"},
+		{"ETH", "0.000000000000000001", "0.0000000000000000001"},
+	}
+
+	for _, c := range cases {
+		if err := pgperf.ValidateAmountScale(decimal.RequireFromString(c.valid), c.currency); err != nil {
+			t.Errorf("expected %s %s to be valid: %v", c.valid, c.currency, err)
+		}
+
+		if err := pgperf.ValidateAmountScale(decimal.RequireFromString(c.invalid), c.currency); err == nil {
+			t.Errorf("expected %s %s to be invalid", c.invalid, c.currency)
+		}
+	}
+}
+
+func TestValidateAmountScaleTrailingZeroes(t *testing.T) {
+	if err := pgperf.ValidateAmountScale(decimal.RequireFromString("1.500000"), "IDRT"); err != nil {
+		t.Fatalf("expected trailing zeroes to be ignored: %v", err)
+	}
+}
+
+func TestValidateAmountScaleUnknownCurrency(t *testing.T) {
+	if err := pgperf.ValidateAmountScale(decimal.NewFromInt(1), "XXX"); err == nil {
+		t.Fatal("expected unknown currency to be rejected")
+	}
+}
+
+func TestValidateAmount(t *testing.T) {
+	if err := pgperf.ValidateAmount(decimal.RequireFromString("1.00"), 2); err != nil {
+		t.Fatalf("expected 1.00 to be valid: %v", err)
+	}
+
+	if err := pgperf.ValidateAmount(decimal.RequireFromString("1.005"), 2); !errors.Is(err, pgperf.ErrTooManyDecimals) {
+		t.Fatalf("expected too many decimals error, got %v", err)
+	}
+
+	for _, amt := range []string{"0", "-1"} {
+		if err := pgperf.ValidateAmount(decimal.RequireFromString(amt), 2); !errors.Is(err, pgperf.ErrNegativeAmount) {
+			t.Fatalf("expected %s to be rejected as negative, got %v", amt, err)
+		}
+	}
+}
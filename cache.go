@@ -0,0 +1,144 @@
+package pgperf
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// CachedReader is a read-through cache of user names. Up to Size least recently used
+// names are kept for TTL, so repeated reads of the same user do not hit the database.
+// Cache does not see changes made by others: writes have to go through CachedReader
+// or call Invalidate after they commit, otherwise stale names are returned until they expire.
+type CachedReader struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	entries map[int]*list.Element
+	// gen is incremented by every invalidation, so names read before it are not cached.
+	gen uint64
+	// lru has most recently used entries at the front.
+	lru *list.List
+}
+
+type cacheEntry struct {
+	id      int
+	name    string
+	expires time.Time
+}
+
+// NewCachedReader creates cache of size names, each kept for ttl.
+func NewCachedReader(size int, ttl time.Duration) *CachedReader {
+	if size < 1 {
+		size = 1
+	}
+
+	return &CachedReader{
+		size:    size,
+		ttl:     ttl,
+		entries: make(map[int]*list.Element, size),
+		lru:     list.New(),
+	}
+}
+
+// GetUser returns name of user from cache, reading it with tx on cache miss.
+// Whatever tx sees gets cached, so tx must not change users itself (its changes could roll back)
+// and must be read committed (an older repeatable read snapshot could bring back a name
+// invalidated since then). A name is not cached if there was an invalidation while it was read.
+func (c *CachedReader) GetUser(ctx context.Context, tx pgx.Tx, id int) (string, error) {
+	name, gen, ok := c.get(id)
+	if ok {
+		return name, nil
+	}
+
+	if err := tx.QueryRow(ctx, "select name from test.users where id = $1", id).Scan(&name); err != nil {
+		return "", MapError(fmt.Errorf("failed to select user %w", err))
+	}
+
+	c.put(id, name, gen)
+
+	return name, nil
+}
+
+// InsertUsers upserts users with UpsertUsersOnConflict in a transaction of its own
+// and invalidates their cached names after it commits.
+func (c *CachedReader) InsertUsers(ctx context.Context, pool *pgxpool.Pool, ids []int) error {
+	err := WithTx(ctx, pool, func(tx pgx.Tx) error {
+		return UpsertUsersOnConflict(ctx, tx, ids)
+	})
+
+	// Invalidate even on error: commit could have succeeded on the server.
+	c.Invalidate(ids...)
+
+	return err
+}
+
+// Invalidate removes names of users from the cache. Names that are being read at the
+// same time are not cached either, so call it after the change is committed.
+func (c *CachedReader) Invalidate(ids ...int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for _, id := range ids {
+		if e, ok := c.entries[id]; ok {
+			c.remove(e)
+		}
+	}
+}
+
+// get returns cached name of user. On cache miss it returns current generation to pass to put.
+func (c *CachedReader) get(id int) (string, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok {
+		return "", c.gen, false
+	}
+
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(e)
+		return "", c.gen, false
+	}
+
+	c.lru.MoveToFront(e)
+
+	return entry.name, c.gen, true
+}
+
+// put caches name read in generation gen, unless something was invalidated since then.
+func (c *CachedReader) put(id int, name string, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+
+	expires := time.Now().Add(c.ttl)
+	if e, ok := c.entries[id]; ok {
+		entry := e.Value.(*cacheEntry)
+		entry.name, entry.expires = name, expires
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.entries[id] = c.lru.PushFront(&cacheEntry{id: id, name: name, expires: expires})
+	if c.lru.Len() > c.size {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove must be called with mu held.
+func (c *CachedReader) remove(e *list.Element) {
+	c.lru.Remove(e)
+	delete(c.entries, e.Value.(*cacheEntry).id)
+}
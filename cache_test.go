@@ -0,0 +1,76 @@
+package pgperf_test
+
+import (
+	"testing"
+	"time"
+
+	"pgperf"
+)
+
+func TestCachedReader(t *testing.T) {
+	requireDB(t)
+
+	tracer := &recordingTracer{}
+	p, err := pgperf.NewTunedPool(ctx, connString, pgperf.WithTracer(tracer))
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer p.Close()
+
+	tx, err := p.Begin(ctx)
+	if err != nil {
+		t.Fatalf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	queries := func() int {
+		tracer.mu.Lock()
+		defer tracer.mu.Unlock()
+		return len(tracer.spans)
+	}
+
+	c := pgperf.NewCachedReader(2, 100*time.Millisecond)
+	get := func(id int) string {
+		t.Helper()
+		name, err := c.GetUser(ctx, tx, id)
+		if err != nil {
+			t.Fatalf("failed to get user %d: %v", id, err)
+		}
+
+		return name
+	}
+
+	get(1)
+	n := queries()
+	get(1)
+	if queries() != n {
+		t.Fatal("expected second read to be served from cache")
+	}
+
+	// Least recently used user 1 is evicted.
+	get(2)
+	get(3)
+	n = queries()
+	get(1)
+	if queries() != n+1 {
+		t.Fatal("expected evicted user to be read from the database")
+	}
+
+	// Upsert keeps the name, but the cached one is invalidated anyway.
+	if err := c.InsertUsers(ctx, p, []int{1}); err != nil {
+		t.Fatalf("failed to insert users: %v", err)
+	}
+
+	n = queries()
+	get(1)
+	if queries() != n+1 {
+		t.Fatal("expected invalidated user to be read from the database")
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	n = queries()
+	get(1)
+	if queries() != n+1 {
+		t.Fatal("expected expired user to be read from the database")
+	}
+}
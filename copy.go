@@ -0,0 +1,61 @@
+package pgperf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// ExportUsers streams all users to w as CSV with a header using `copy ... to stdout`.
+// Rows are written as they come from the server, without materializing them in memory.
+// Returns number of exported rows.
+func ExportUsers(ctx context.Context, conn *pgxpool.Conn, w io.Writer) (int64, error) {
+	tag, err := conn.Conn().PgConn().CopyTo(ctx, w, "copy (select id, name from test.users) to stdout with csv header")
+	if err != nil {
+		return 0, fmt.Errorf("failed to export users: %w", err)
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// ImportUsers loads users from CSV with a header (as written by ExportUsers) using
+// `copy ... from stdin`. Unlike InsertUsers6, rows are streamed from r to the server
+// without being parsed in Go. Import is atomic: a malformed row fails the whole copy,
+// and the error includes the CSV line it happened on (original *pgconn.PgError is
+// available with errors.As). Returns number of imported rows.
+func ImportUsers(ctx context.Context, conn *pgxpool.Conn, r io.Reader) (int64, error) {
+	tag, err := conn.Conn().PgConn().CopyFrom(ctx, r, "copy test.users(id, name) from stdin with csv header")
+	if err != nil {
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Where != "" {
+			return 0, MapError(fmt.Errorf("failed to import users (%s): %w", pgErr.Where, err))
+		}
+
+		return 0, MapError(fmt.Errorf("failed to import users: %w", err))
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// CopyInsert copies rows into columns of table with CopyFrom (like InsertUsers6 does for
+// test.users). Values of every row must be in the order of columns, which may differ from
+// the order of table columns. Returns number of copied rows.
+func CopyInsert(ctx context.Context, tx pgx.Tx, table pgx.Identifier, columns []string, rows [][]interface{}) (int64, error) {
+	for i, row := range rows {
+		if len(row) != len(columns) {
+			return 0, fmt.Errorf("row %d has %d values, expected %d", i, len(row), len(columns))
+		}
+	}
+
+	n, err := tx.CopyFrom(ctx, table, columns, pgx.CopyFromRows(rows))
+	if err != nil {
+		return 0, MapError(fmt.Errorf("failed to copy into %s: %w", table.Sanitize(), err))
+	}
+
+	return n, nil
+}
@@ -0,0 +1,114 @@
+package pgperf_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"pgperf"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestExportUsers(t *testing.T) {
+	requireDB(t)
+
+	conn, err := getConn(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	// Export and import run on the same connection, so they see the transaction.
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	var buf bytes.Buffer
+	exported, err := pgperf.ExportUsers(ctx, conn, &buf)
+	if err != nil {
+		t.Fatalf("failed to export users: %v", err)
+	}
+
+	if header, _, _ := strings.Cut(buf.String(), "\n"); header != "id,name" {
+		t.Fatalf("expected CSV header, got %q", header)
+	}
+
+	if _, err := tx.Exec(ctx, "truncate test.users cascade"); err != nil {
+		t.Fatalf("failed to truncate users: %v", err)
+	}
+
+	imported, err := pgperf.ImportUsers(ctx, conn, &buf)
+	if err != nil {
+		t.Fatalf("failed to import users: %v", err)
+	}
+
+	if imported != exported {
+		t.Fatalf("exported %d users, but imported %d", exported, imported)
+	}
+}
+
+func TestImportUsersMalformed(t *testing.T) {
+	requireDB(t)
+
+	conn, err := getConn(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	csv := "id,name\n4000001,ok\nnot a number,broken\n"
+	_, err = pgperf.ImportUsers(ctx, conn, strings.NewReader(csv))
+
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		t.Fatalf("expected PgError, got %v", err)
+	}
+
+	if !strings.Contains(err.Error(), "line 3") {
+		t.Fatalf("expected error to point at line 3, got %v", err)
+	}
+}
+
+func TestCopyInsert(t *testing.T) {
+	tx := testTx(t)
+
+	// Columns are in reverse order relative to the table definition.
+	rows := [][]interface{}{
+		{"copied 1", 4500001},
+		{"copied 2", 4500002},
+	}
+
+	n, err := pgperf.CopyInsert(ctx, tx, pgx.Identifier{"test", "users"}, []string{"name", "id"}, rows)
+	if err != nil {
+		t.Fatalf("failed to copy users: %v", err)
+	}
+
+	if n != int64(len(rows)) {
+		t.Fatalf("expected %d rows copied, got %d", len(rows), n)
+	}
+
+	names, err := pgperf.GetUsersOrdered(ctx, tx, []int{4500001, 4500002})
+	if err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	if len(names) != 2 || names[0] != "copied 1" || names[1] != "copied 2" {
+		t.Fatalf("unexpected names %v", names)
+	}
+
+	_, err = pgperf.CopyInsert(ctx, tx, pgx.Identifier{"test", "users"}, []string{"id", "name"}, [][]interface{}{{4500003}})
+	if err == nil {
+		t.Fatal("expected row length mismatch error")
+	}
+}
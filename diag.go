@@ -0,0 +1,317 @@
+package pgperf
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// commitSamples is the number of transactions EstimateMaxTPS commits to measure commit latency.
+const commitSamples = 50
+
+// EstimateMaxTPS estimates throughput ceiling for a transfer-like workload bounded by commit latency.
+// It commits a series of tiny transactions (each one gets an xid, so commit has to flush WAL)
+// and measures mean latency. One connection can't do better than 1/latency transactions
+// per second, which is then multiplied by concurrency: the number of connections running
+// transactions at the same time (e.g. the pool's MaxConns).
+//
+// The model assumes that:
+//   - synchronous_commit is on, so every commit waits for WAL fsync;
+//   - commit latency dominates, i.e. the real transaction work is negligible;
+//   - concurrency connections commit all the time, and their commits do not slow
+//     each other down (no lock contention, no IO saturation).
+//
+// Group commit can make real numbers higher, lock contention makes them (much) lower.
+func EstimateMaxTPS(ctx context.Context, conn *pgxpool.Conn, concurrency int) (float64, error) {
+	if concurrency < 1 {
+		return 0, fmt.Errorf("invalid concurrency %d", concurrency)
+	}
+
+	var total time.Duration
+	for i := 0; i < commitSamples; i++ {
+		start := time.Now()
+		tx, err := conn.Begin(ctx)
+		if err != nil {
+			return 0, fmt.Errorf("failed to start transaction: %w", err)
+		}
+
+		if _, err := tx.Exec(ctx, "select txid_current()"); err != nil {
+			tx.Rollback(ctx)
+			return 0, fmt.Errorf("failed to assign xid: %w", err)
+		}
+
+		if err := tx.Commit(ctx); err != nil {
+			return 0, fmt.Errorf("failed to commit: %w", err)
+		}
+		total += time.Since(start)
+	}
+
+	latency := total / commitSamples
+	if latency <= 0 {
+		return 0, errors.New("failed to measure commit latency")
+	}
+
+	perConn := float64(time.Second) / float64(latency)
+
+	return perConn * float64(concurrency), nil
+}
+
+// LockHolder is a transaction holding a lock on test.accounts.
+type LockHolder struct {
+	PID   int
+	Mode  string
+	State string
+	Query string
+	// Held is the age of the transaction holding the lock.
+	Held time.Duration
+}
+
+// LongLockHolders returns transactions that hold granted locks on test.accounts table
+// for longer than threshold. Lock hold time is approximated by transaction age,
+// since Postgres does not track when a particular lock was acquired.
+func LongLockHolders(ctx context.Context, conn *pgxpool.Conn, threshold time.Duration) ([]LockHolder, error) {
+	q := `select a.pid,
+	             l.mode,
+	             coalesce(a.state, ''),
+	             coalesce(a.query, ''),
+	             extract(epoch from now() - a.xact_start)::float8
+	        from pg_locks l
+	        join pg_stat_activity a on (a.pid = l.pid)
+	       where l.relation = 'test.accounts'::regclass
+	         and l.granted
+	         and a.pid <> pg_backend_pid()
+	         and now() - a.xact_start > make_interval(secs => $1)
+	       order by a.xact_start`
+
+	rows, err := conn.Query(ctx, q, threshold.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to query locks: %w", err)
+	}
+	defer rows.Close()
+
+	var holders []LockHolder
+	for rows.Next() {
+		var (
+			h    LockHolder
+			secs float64
+		)
+		if err := rows.Scan(&h.PID, &h.Mode, &h.State, &h.Query, &secs); err != nil {
+			return nil, fmt.Errorf("failed to scan lock holder: %w", err)
+		}
+
+		h.Held = time.Duration(secs * float64(time.Second))
+		holders = append(holders, h)
+	}
+
+	return holders, rows.Err()
+}
+
+// Explain runs query with `explain (analyze, buffers, format text)` and returns the plan.
+// Query is really executed, so explaining a data-modifying statement inside a transaction
+// that is rolled back afterwards is a good idea.
+func Explain(ctx context.Context, tx pgx.Tx, query string, args ...interface{}) (string, error) {
+	rows, err := tx.Query(ctx, "explain (analyze, buffers, format text) "+query, args...)
+	if err != nil {
+		return "", fmt.Errorf("failed to explain query: %w", err)
+	}
+	defer rows.Close()
+
+	var sb strings.Builder
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return "", fmt.Errorf("failed to scan plan line: %w", err)
+		}
+
+		sb.WriteString(line)
+		sb.WriteRune('\n')
+	}
+
+	return sb.String(), rows.Err()
+}
+
+// PlanNode is a node of a query plan as reported by `explain (format json)`.
+type PlanNode struct {
+	NodeType        string     `json:"Node Type"`
+	RelationName    string     `json:"Relation Name"`
+	IndexName       string     `json:"Index Name"`
+	StartupCost     float64    `json:"Startup Cost"`
+	TotalCost       float64    `json:"Total Cost"`
+	PlanRows        float64    `json:"Plan Rows"`
+	ActualTotalTime float64    `json:"Actual Total Time"`
+	ActualRows      float64    `json:"Actual Rows"`
+	ActualLoops     float64    `json:"Actual Loops"`
+	Plans           []PlanNode `json:"Plans"`
+}
+
+// ExplainJSON runs query with `explain (analyze, format json)` and returns the top plan node.
+// As with Explain, the query is really executed.
+func ExplainJSON(ctx context.Context, tx pgx.Tx, query string, args ...interface{}) (PlanNode, error) {
+	var out []byte
+	if err := tx.QueryRow(ctx, "explain (analyze, format json) "+query, args...).Scan(&out); err != nil {
+		return PlanNode{}, fmt.Errorf("failed to explain query: %w", err)
+	}
+
+	var plans []struct {
+		Plan PlanNode `json:"Plan"`
+	}
+	if err := json.Unmarshal(out, &plans); err != nil {
+		return PlanNode{}, fmt.Errorf("failed to parse plan: %w", err)
+	}
+
+	if len(plans) == 0 {
+		return PlanNode{}, errors.New("explain returned no plan")
+	}
+
+	return plans[0].Plan, nil
+}
+
+// minSeqTupPerScan is the average number of rows read by a sequential scan
+// above which a table is considered for an index.
+const minSeqTupPerScan = 1000
+
+// IndexSuggestion is a table that is mostly read with sequential scans of many rows.
+type IndexSuggestion struct {
+	Schema     string
+	Table      string
+	SeqScan    int64
+	SeqTupRead int64
+	IdxScan    int64
+	// AvgSeqRead is the average number of rows read by one sequential scan.
+	AvgSeqRead float64
+}
+
+// SuggestMissingIndexes returns tables that are scanned sequentially more often than with an index,
+// reading many rows per scan. It's a heuristic based on cumulative statistics in pg_stat_user_tables
+// (since the last stats reset): a small table or a reporting query can legitimately look the same,
+// so check the queries (see Explain) before adding an index.
+func SuggestMissingIndexes(ctx context.Context, conn *pgxpool.Conn) ([]IndexSuggestion, error) {
+	q := `select schemaname,
+	             relname,
+	             seq_scan,
+	             seq_tup_read,
+	             coalesce(idx_scan, 0),
+	             seq_tup_read::float8 / seq_scan
+	        from pg_stat_user_tables
+	       where seq_scan > 0
+	         and seq_scan > coalesce(idx_scan, 0)
+	         and seq_tup_read / seq_scan >= $1
+	       order by seq_tup_read desc`
+
+	rows, err := conn.Query(ctx, q, minSeqTupPerScan)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query table stats: %w", err)
+	}
+	defer rows.Close()
+
+	var res []IndexSuggestion
+	for rows.Next() {
+		var s IndexSuggestion
+		if err := rows.Scan(&s.Schema, &s.Table, &s.SeqScan, &s.SeqTupRead, &s.IdxScan, &s.AvgSeqRead); err != nil {
+			return nil, fmt.Errorf("failed to scan table stats: %w", err)
+		}
+
+		res = append(res, s)
+	}
+
+	return res, rows.Err()
+}
+
+// CreateIndex creates index name on schema.table(columns) unless it already exists.
+// All names are quoted, so they can come from configuration. It fails if name is taken
+// by another relation or by an index on a different table (definitions of indexes on the same
+// table are not compared).
+func CreateIndex(ctx context.Context, conn *pgxpool.Conn, schema, table, name string, columns ...string) error {
+	if len(columns) == 0 {
+		return errors.New("index must have at least one column")
+	}
+
+	qualified, err := Qualify(schema, table)
+	if err != nil {
+		return err
+	}
+
+	cols := make([]string, len(columns))
+	for i, c := range columns {
+		cols[i] = pgx.Identifier{c}.Sanitize()
+	}
+
+	stmt := fmt.Sprintf("create index if not exists %s on %s(%s)", pgx.Identifier{name}.Sanitize(), qualified, strings.Join(cols, ", "))
+	if _, err := conn.Exec(ctx, stmt); err != nil {
+		return fmt.Errorf("failed to create index: %w", err)
+	}
+
+	// `if not exists` silently skips creation if the name is taken by anything.
+	var indexTable string
+	q := "select tablename from pg_indexes where schemaname = $1 and indexname = $2"
+	if err := conn.QueryRow(ctx, q, schema, name).Scan(&indexTable); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return fmt.Errorf("failed to create index: relation %s.%s already exists and is not an index", schema, name)
+		}
+		return fmt.Errorf("failed to check index: %w", err)
+	}
+
+	if indexTable != table {
+		return fmt.Errorf("failed to create index: %s.%s already exists on table %s", schema, name, indexTable)
+	}
+
+	return nil
+}
+
+// DropIndex drops index schema.name if it exists.
+func DropIndex(ctx context.Context, conn *pgxpool.Conn, schema, name string) error {
+	index, err := Qualify(schema, name)
+	if err != nil {
+		return err
+	}
+
+	if _, err := conn.Exec(ctx, "drop index if exists "+index); err != nil {
+		return fmt.Errorf("failed to drop index %s: %w", index, err)
+	}
+
+	return nil
+}
+
+// EstimateRowCount returns approximate number of rows in a table from pg_class, which
+// is much cheaper than count(*) on a big table. Like the planner does, it scales
+// reltuples/relpages density to the current table size, so the estimate follows table growth
+// between ANALYZE runs, but it's only as accurate as the last ANALYZE (or autovacuum).
+// Returns 0 for a table that was never analyzed.
+func EstimateRowCount(ctx context.Context, tx pgx.Tx, schema, table string) (int64, error) {
+	q := `select case
+	                 when c.reltuples < 0 then 0
+	                 when c.relpages = 0 then c.reltuples::bigint
+	                 else (c.reltuples / c.relpages
+	                       * (pg_relation_size(c.oid) / current_setting('block_size')::int))::bigint
+	             end
+	        from pg_class c
+	       where c.oid = $1::regclass`
+
+	var n int64
+	if err := tx.QueryRow(ctx, q, pgx.Identifier{schema, table}.Sanitize()).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to estimate row count: %w", err)
+	}
+
+	return n, nil
+}
+
+// QueryWithThreshold runs query and reports whether it took longer than threshold,
+// so callers can log slow queries. Only the Query call is timed, not reading rows:
+// it returns when the server starts sending results, which for small results
+// means after the query is executed. Caller must close returned rows.
+func QueryWithThreshold(ctx context.Context, tx pgx.Tx, threshold time.Duration, sql string, args ...interface{}) (pgx.Rows, bool, error) {
+	start := time.Now()
+	rows, err := tx.Query(ctx, sql, args...)
+	slow := time.Since(start) > threshold
+	if err != nil {
+		return nil, slow, MapError(fmt.Errorf("failed to query: %w", err))
+	}
+
+	return rows, slow, nil
+}
@@ -0,0 +1,245 @@
+package pgperf_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"pgperf"
+)
+
+func TestEstimateMaxTPS(t *testing.T) {
+	requireDB(t)
+
+	conn, err := getConn(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	tps, err := pgperf.EstimateMaxTPS(ctx, conn, int(pool.Config().MaxConns))
+	if err != nil {
+		t.Fatalf("failed to estimate TPS: %v", err)
+	}
+
+	if tps <= 0 || tps > 10000000 {
+		t.Fatalf("implausible TPS estimate %f", tps)
+	}
+
+	if _, err := pgperf.EstimateMaxTPS(ctx, conn, 0); err == nil {
+		t.Fatal("expected error for zero concurrency")
+	}
+}
+
+func TestLongLockHolders(t *testing.T) {
+	tx := testTx(t)
+
+	var id int
+	if err := tx.QueryRow(ctx, "select id from test.accounts order by id limit 1 for update").Scan(&id); err != nil {
+		t.Fatalf("failed to lock account: %v", err)
+	}
+	pid := int(tx.Conn().PgConn().PID())
+
+	const threshold = 10 * time.Millisecond
+	time.Sleep(5 * threshold)
+
+	conn, err := getConn(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	holders, err := pgperf.LongLockHolders(ctx, conn, threshold)
+	if err != nil {
+		t.Fatalf("failed to get lock holders: %v", err)
+	}
+
+	for _, h := range holders {
+		if h.PID == pid {
+			if h.Held < threshold {
+				t.Fatalf("expected lock to be held at least %v, got %v", threshold, h.Held)
+			}
+			return
+		}
+	}
+
+	t.Fatalf("lock holder %d is not reported: %+v", pid, holders)
+}
+
+func TestExplain(t *testing.T) {
+	tx := testTx(t)
+
+	plan, err := pgperf.Explain(ctx, tx, "select name from test.users where id = any($1)", []int{1, 2, 3})
+	if err != nil {
+		t.Fatalf("failed to explain query: %v", err)
+	}
+
+	if !strings.Contains(plan, "users_pkey") || !strings.Contains(plan, "Execution Time") {
+		t.Fatalf("unexpected plan:\n%s", plan)
+	}
+}
+
+func TestExplainJSON(t *testing.T) {
+	tx := testTx(t)
+
+	plan, err := pgperf.ExplainJSON(ctx, tx, "select name from test.users where id = any($1)", []int{1, 2, 3})
+	if err != nil {
+		t.Fatalf("failed to explain query: %v", err)
+	}
+
+	var walk func(n pgperf.PlanNode)
+	walk = func(n pgperf.PlanNode) {
+		if n.NodeType == "Seq Scan" {
+			t.Fatalf("expected index scan, got seq scan on %s", n.RelationName)
+		}
+
+		for _, child := range n.Plans {
+			walk(child)
+		}
+	}
+	walk(plan)
+
+	if plan.ActualRows != 3 {
+		t.Fatalf("expected 3 rows, got %v", plan.ActualRows)
+	}
+}
+
+func TestSuggestMissingIndexes(t *testing.T) {
+	requireDB(t)
+
+	conn, err := getConn(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	// Benchmarks make lots of index scans on users, start from scratch.
+	if _, err := conn.Exec(ctx, "select pg_stat_reset_single_table_counters('test.users'::regclass)"); err != nil {
+		t.Fatalf("failed to reset table stats: %v", err)
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		t.Fatalf("failed to start transaction: %v", err)
+	}
+
+	for _, q := range []string{"set local enable_indexscan = off", "set local enable_bitmapscan = off"} {
+		if _, err := tx.Exec(ctx, q); err != nil {
+			t.Fatalf("failed to disable index scans: %v", err)
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, err := pgperf.GetUsers4(ctx, tx, []int{i + 1}); err != nil {
+			t.Fatalf("failed to get users: %v", err)
+		}
+	}
+	tx.Rollback(ctx)
+
+	// Statistics are flushed asynchronously, so wait for them to show up.
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		suggestions, err := pgperf.SuggestMissingIndexes(ctx, conn)
+		if err != nil {
+			t.Fatalf("failed to get index suggestions: %v", err)
+		}
+
+		for _, s := range suggestions {
+			if s.Schema == "test" && s.Table == "users" {
+				return
+			}
+		}
+
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	t.Fatal("users table is not suggested for an index")
+}
+
+func TestEstimateRowCount(t *testing.T) {
+	tx := testTx(t)
+
+	if _, err := tx.Exec(ctx, "analyze test.users"); err != nil {
+		t.Fatalf("failed to analyze users: %v", err)
+	}
+
+	var exact int64
+	if err := tx.QueryRow(ctx, "select count(*) from test.users").Scan(&exact); err != nil {
+		t.Fatalf("failed to count users: %v", err)
+	}
+
+	n, err := pgperf.EstimateRowCount(ctx, tx, "test", "users")
+	if err != nil {
+		t.Fatalf("failed to estimate row count: %v", err)
+	}
+
+	// Estimate is based on a sample, allow some error.
+	if diff := float64(n-exact) / float64(exact); diff > 0.1 || diff < -0.1 {
+		t.Fatalf("estimate %d is too far from exact count %d", n, exact)
+	}
+}
+
+func TestQueryWithThreshold(t *testing.T) {
+	tx := testTx(t)
+
+	for _, c := range []struct {
+		sql  string
+		slow bool
+	}{
+		{"select 1", false},
+		{"select 1 from pg_sleep(0.3)", true},
+	} {
+		rows, slow, err := pgperf.QueryWithThreshold(ctx, tx, 200*time.Millisecond, c.sql)
+		if err != nil {
+			t.Fatalf("failed to run %q: %v", c.sql, err)
+		}
+		rows.Close()
+
+		if slow != c.slow {
+			t.Fatalf("expected %q slow to be %v", c.sql, c.slow)
+		}
+	}
+}
+
+func TestCreateDropIndex(t *testing.T) {
+	requireDB(t)
+
+	conn, err := getConn(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	t.Cleanup(func() { pgperf.DropIndex(ctx, conn, "test", "users_archive_name_i") })
+
+	// Both calls are safe to repeat.
+	for i := 0; i < 2; i++ {
+		if err := pgperf.CreateIndex(ctx, conn, "test", "users_archive", "users_archive_name_i", "name"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Name taken by an index on another table or by a table is an error.
+	if err := pgperf.CreateIndex(ctx, conn, "test", "users", "users_archive_name_i", "name"); err == nil {
+		t.Fatal("expected error for index name taken on another table")
+	}
+
+	if err := pgperf.CreateIndex(ctx, conn, "test", "users", "users_archive", "name"); err == nil {
+		t.Fatal("expected error for index name taken by a table")
+	}
+
+	var exists bool
+	if err := conn.QueryRow(ctx, "select to_regclass('test.users_archive_name_i') is not null").Scan(&exists); err != nil {
+		t.Fatalf("failed to check index: %v", err)
+	}
+
+	if !exists {
+		t.Fatal("expected index to be created")
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := pgperf.DropIndex(ctx, conn, "test", "users_archive_name_i"); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
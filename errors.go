@@ -0,0 +1,84 @@
+package pgperf
+
+import (
+	"errors"
+
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Errors for common PostgreSQL error codes, returned by MapError.
+var (
+	ErrUniqueViolation      = errors.New("unique violation")
+	ErrForeignKeyViolation  = errors.New("foreign key violation")
+	ErrSerializationFailure = errors.New("serialization failure")
+	ErrDeadlock             = errors.New("deadlock detected")
+	ErrLockNotAvailable     = errors.New("lock not available")
+	ErrQueryCanceled        = errors.New("query canceled")
+)
+
+// ErrAmountOverflow is returned when a balance would not fit into accounts.amount column.
+var ErrAmountOverflow = errors.New("amount is out of range")
+
+// ErrLockTimeout is returned when a lock is not acquired within lock_timeout.
+// PostgreSQL reports it with the same code as a failed `nowait` lock, so it is ErrLockNotAvailable.
+var ErrLockTimeout = ErrLockNotAvailable
+
+// ErrUnsupportedServerVersion is returned when a feature is not supported by the database server.
+var ErrUnsupportedServerVersion = errors.New("unsupported server version")
+
+// pgErrorCodes maps PostgreSQL error codes to package errors.
+var pgErrorCodes = map[string]error{
+	"23505": ErrUniqueViolation,
+	"23503": ErrForeignKeyViolation,
+	"40001": ErrSerializationFailure,
+	"40P01": ErrDeadlock,
+	"55P03": ErrLockNotAvailable,
+	// Statement timeout is reported as query_canceled too.
+	"57014": ErrQueryCanceled,
+}
+
+// mappedError is a database error classified with one of package errors.
+type mappedError struct {
+	kind error
+	err  error
+}
+
+func (e *mappedError) Error() string {
+	return e.kind.Error() + ": " + e.err.Error()
+}
+
+func (e *mappedError) Is(target error) bool {
+	return target == e.kind
+}
+
+func (e *mappedError) Unwrap() error {
+	return e.err
+}
+
+// mapAmountError is MapError that also classifies numeric_value_out_of_range as ErrAmountOverflow.
+// It is only meant for statements where the only numeric values are amounts (e.g. balance updates),
+// elsewhere the same code can be caused by an id or any other number.
+func mapAmountError(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "22003" {
+		return &mappedError{kind: ErrAmountOverflow, err: err}
+	}
+
+	return MapError(err)
+}
+
+// MapError classifies err by its PostgreSQL error code, so callers can check it with
+// errors.Is(err, ErrUniqueViolation) etc. Original error is still available with errors.As.
+// Errors with other codes (and nil) are returned as is.
+func MapError(err error) error {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) {
+		return err
+	}
+
+	if kind, ok := pgErrorCodes[pgErr.Code]; ok {
+		return &mappedError{kind: kind, err: err}
+	}
+
+	return err
+}
@@ -0,0 +1,122 @@
+package pgperf_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"pgperf"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestMapError(t *testing.T) {
+	cases := map[string]error{
+		"23505": pgperf.ErrUniqueViolation,
+		"23503": pgperf.ErrForeignKeyViolation,
+		"40001": pgperf.ErrSerializationFailure,
+		"40P01": pgperf.ErrDeadlock,
+		"55P03": pgperf.ErrLockNotAvailable,
+		"57014": pgperf.ErrQueryCanceled,
+	}
+
+	for code, expected := range cases {
+		pgErr := &pgconn.PgError{Code: code}
+		err := pgperf.MapError(fmt.Errorf("wrapped: %w", pgErr))
+		if !errors.Is(err, expected) {
+			t.Errorf("expected %s to map to %v, got %v", code, expected, err)
+		}
+
+		var unwrapped *pgconn.PgError
+		if !errors.As(err, &unwrapped) || unwrapped != pgErr {
+			t.Errorf("original error is lost for %s", code)
+		}
+	}
+
+	if err := pgperf.MapError(nil); err != nil {
+		t.Errorf("expected nil, got %v", err)
+	}
+
+	// Numeric overflow is not necessarily about amounts, so it is not mapped globally.
+	if err := pgperf.MapError(&pgconn.PgError{Code: "22003"}); errors.Is(err, pgperf.ErrAmountOverflow) {
+		t.Errorf("expected 22003 not to be mapped to ErrAmountOverflow, got %v", err)
+	}
+
+	other := &pgconn.PgError{Code: "42P01"}
+	if err := pgperf.MapError(other); err != other {
+		t.Errorf("expected unknown code error to be returned as is, got %v", err)
+	}
+}
+
+func TestInsertDuplicateUser(t *testing.T) {
+	tx := testTx(t)
+
+	err := pgperf.InsertUsers1(ctx, tx, []int{1})
+	if !errors.Is(err, pgperf.ErrUniqueViolation) {
+		t.Fatalf("expected unique violation, got %v", err)
+	}
+}
+
+// forceDeadlock makes two transactions lock two accounts in opposite order and returns
+// the error of the one Postgres picked as deadlock victim. Both transactions are rolled back.
+// Each transaction locks its first account before any of them goes for the second one,
+// so the deadlock does not depend on timing.
+func forceDeadlock(tb testing.TB, pool *pgxpool.Pool) error {
+	tb.Helper()
+
+	ids := idrtAccounts(tb, pool, 2)
+
+	const lock = "update test.accounts set amount = amount where id = $1"
+
+	var (
+		locked sync.WaitGroup
+		wg     sync.WaitGroup
+		errs   = make([]error, 2)
+	)
+	locked.Add(2)
+	wg.Add(2)
+	for i := 0; i < 2; i++ {
+		i := i
+		go func() {
+			defer wg.Done()
+
+			tx, err := pool.Begin(ctx)
+			if err != nil {
+				errs[i] = err
+				locked.Done()
+				return
+			}
+			defer tx.Rollback(ctx)
+
+			_, err = tx.Exec(ctx, lock, ids[i])
+			locked.Done()
+			if err != nil {
+				errs[i] = err
+				return
+			}
+
+			// Both first locks are taken, now each transaction waits for the other one.
+			locked.Wait()
+			_, errs[i] = tx.Exec(ctx, lock, ids[1-i])
+		}()
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return pgperf.MapError(err)
+		}
+	}
+
+	return errors.New("no deadlock happened")
+}
+
+func TestDeadlockIsMapped(t *testing.T) {
+	requireDB(t)
+
+	if err := forceDeadlock(t, pool); !errors.Is(err, pgperf.ErrDeadlock) {
+		t.Fatalf("expected deadlock error, got %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+package pgperf
+
+import (
+	"sort"
+	"sync"
+)
+
+// TransferCounter counts successful transfers per account during a contention run.
+// It is safe for concurrent use.
+type TransferCounter struct {
+	mu     sync.Mutex
+	counts map[int]int
+}
+
+// NewTransferCounter creates counter for accounts ids. Accounts are registered up front,
+// so the ones that never got a successful transfer show up in the report with zero count.
+func NewTransferCounter(ids []int) *TransferCounter {
+	counts := make(map[int]int, len(ids))
+	for _, id := range ids {
+		counts[id] = 0
+	}
+
+	return &TransferCounter{counts: counts}
+}
+
+// Record registers a successful (committed) transfer between from and to accounts.
+func (c *TransferCounter) Record(from, to int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.counts[from]++
+	c.counts[to]++
+}
+
+// FairnessReport describes how evenly successful transfers were distributed among accounts.
+type FairnessReport struct {
+	// Counts is the number of successful transfers per account.
+	Counts map[int]int
+	Min    int
+	Max    int
+	Mean   float64
+	// Gini coefficient of the counts: 0 means all accounts got the same number of transfers,
+	// values close to 1 mean few accounts got almost all of them (others are starved).
+	Gini float64
+}
+
+// Report returns current fairness report.
+func (c *TransferCounter) Report() FairnessReport {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r := FairnessReport{Counts: make(map[int]int, len(c.counts))}
+	values := make([]int, 0, len(c.counts))
+	for id, n := range c.counts {
+		r.Counts[id] = n
+		values = append(values, n)
+	}
+
+	if len(values) == 0 {
+		return r
+	}
+
+	sort.Ints(values)
+	r.Min, r.Max = values[0], values[len(values)-1]
+
+	var sum, weighted float64
+	for i, v := range values {
+		sum += float64(v)
+		weighted += float64(i+1) * float64(v)
+	}
+
+	n := float64(len(values))
+	r.Mean = sum / n
+	if sum > 0 {
+		r.Gini = 2*weighted/(n*sum) - (n+1)/n
+	}
+
+	return r
+}
@@ -0,0 +1,88 @@
+package pgperf_test
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"pgperf"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestFairnessReportGini(t *testing.T) {
+	c := pgperf.NewTransferCounter([]int{1, 2, 3, 4})
+	for i := 0; i < 10; i++ {
+		c.Record(1, 2)
+		c.Record(3, 4)
+	}
+
+	r := c.Report()
+	if r.Gini != 0 || r.Min != 10 || r.Max != 10 || r.Mean != 10 {
+		t.Fatalf("expected even distribution, got %+v", r)
+	}
+
+	c = pgperf.NewTransferCounter([]int{1, 2, 3, 4})
+	c.Record(1, 2)
+
+	r = c.Report()
+	if math.Abs(r.Gini-0.5) > 1e-9 || r.Min != 0 || r.Max != 1 {
+		t.Fatalf("expected skewed distribution, got %+v", r)
+	}
+}
+
+func TestFairnessUnderContention(t *testing.T) {
+	requireDB(t)
+
+	var ids []int
+	q := `select array_agg(id)
+	from (select id from test.accounts where currency = 'IDRT' and amount > 10000000 limit 10) x`
+	if err := pool.QueryRow(ctx, q).Scan(&ids); err != nil {
+		t.Fatalf("failed to get IDRT accounts: %v", err)
+	}
+
+	counter := pgperf.NewTransferCounter(ids)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				// Skewed workload: most transfers go through the first (hot) account.
+				from, to := ids[0], ids[1+rand.Intn(len(ids)-1)]
+				if rand.Intn(5) == 0 {
+					from = ids[1+rand.Intn(len(ids)-1)]
+				}
+
+				tx, err := pool.Begin(ctx)
+				if err != nil {
+					t.Errorf("failed to start transaction: %v", err)
+					return
+				}
+
+				_, err = pgperf.TransferLock(ctx, tx, from, to, decimal.NewFromInt(1))
+				if err == nil {
+					err = tx.Commit(ctx)
+				}
+				tx.Rollback(ctx)
+
+				if err == nil {
+					counter.Record(from, to)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	r := counter.Report()
+	if len(r.Counts) != len(ids) {
+		t.Fatalf("expected %d accounts in report, got %d", len(ids), len(r.Counts))
+	}
+
+	if r.Counts[ids[0]] != r.Max || r.Max == 0 {
+		t.Fatalf("expected hot account to have most transfers, got %+v", r)
+	}
+}
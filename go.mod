@@ -5,6 +5,7 @@ go 1.19
 require (
 	github.com/jackc/pgx/v5 v5.2.0
 	github.com/shopspring/decimal v1.3.1
+	golang.org/x/sync v0.0.0-20220923202941-7f9b1623fab7
 )
 
 require (
@@ -13,6 +14,5 @@ require (
 	github.com/jackc/puddle/v2 v2.1.2 // indirect
 	go.uber.org/atomic v1.10.0 // indirect
 	golang.org/x/crypto v0.0.0-20220829220503-c86fa9a7ed90 // indirect
-	golang.org/x/sync v0.0.0-20220923202941-7f9b1623fab7 // indirect
 	golang.org/x/text v0.3.8 // indirect
 )
@@ -0,0 +1,14 @@
+package pgperf
+
+import "errors"
+
+// Qualify returns schema qualified table name with both parts quoted, so they can
+// safely come from configuration: quotes are escaped and dots do not split the name.
+// Quoting is the same as of Users.Identifier.
+func Qualify(schema, table string) (string, error) {
+	if schema == "" || table == "" {
+		return "", errors.New("schema and table names must not be empty")
+	}
+
+	return Users{Schema: schema, Table: table}.Identifier().Sanitize(), nil
+}
@@ -0,0 +1,36 @@
+package pgperf_test
+
+import (
+	"testing"
+
+	"pgperf"
+)
+
+func TestQualify(t *testing.T) {
+	cases := []struct {
+		schema, table string
+		expected      string
+	}{
+		{"test", "users", `"test"."users"`},
+		{`my"schema`, "users", `"my""schema"."users"`},
+		{"test", "a.b", `"test"."a.b"`},
+		{"test", `users"; drop table test.users; --`, `"test"."users""; drop table test.users; --"`},
+	}
+
+	for _, c := range cases {
+		got, err := pgperf.Qualify(c.schema, c.table)
+		if err != nil {
+			t.Fatalf("failed to qualify %q.%q: %v", c.schema, c.table, err)
+		}
+
+		if got != c.expected {
+			t.Errorf("expected %s, got %s", c.expected, got)
+		}
+	}
+
+	for _, c := range [][2]string{{"", "users"}, {"test", ""}} {
+		if _, err := pgperf.Qualify(c[0], c[1]); err == nil {
+			t.Errorf("expected %q.%q to be rejected", c[0], c[1])
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package pgperf
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/sync/errgroup"
+)
+
+// ingestFlushInterval is how long ingester waits for a batch to fill up before flushing it anyway.
+const ingestFlushInterval = 100 * time.Millisecond
+
+// StartUserIngester starts a goroutine that reads users from returned channel and inserts them
+// with CopyFrom in batches of bufferSize users. Batch is flushed when it is full or when
+// ingestFlushInterval passes since the last flush.
+// Channel has capacity of bufferSize, so when the database can't keep up, sends to it block
+// providing backpressure to the producer.
+// Caller must close input channel when done. Error channel then yields the first error
+// occurred (or nil) and is closed. After an error, including cancellation of ctx,
+// the rest of the input is read and discarded, so producers never block on a dead ingester.
+func StartUserIngester(ctx context.Context, pool *pgxpool.Pool, bufferSize int) (chan<- User, <-chan error) {
+	if bufferSize < 1 {
+		bufferSize = 1
+	}
+
+	in := make(chan User, bufferSize)
+	errc := make(chan error, 1)
+
+	go func() {
+		defer close(errc)
+
+		var (
+			firstErr error
+			batch    = make([][]interface{}, 0, bufferSize)
+			timer    = time.NewTimer(ingestFlushInterval)
+			done     = ctx.Done()
+		)
+		defer timer.Stop()
+
+		flush := func() {
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(ingestFlushInterval)
+
+			if len(batch) == 0 || firstErr != nil {
+				batch = batch[:0]
+				return
+			}
+
+			_, err := pool.CopyFrom(ctx, pgx.Identifier{"test", "users"}, []string{"id", "name"}, pgx.CopyFromRows(batch))
+			if err != nil {
+				firstErr = fmt.Errorf("failed to copy users batch: %w", err)
+			}
+			batch = batch[:0]
+		}
+
+		for {
+			select {
+			case u, ok := <-in:
+				if !ok {
+					flush()
+					errc <- firstErr
+					return
+				}
+
+				if firstErr != nil {
+					continue
+				}
+
+				batch = append(batch, []interface{}{u.ID, u.Name})
+				if len(batch) == bufferSize {
+					flush()
+				}
+			case <-timer.C:
+				flush()
+			case <-done:
+				if firstErr == nil {
+					firstErr = ctx.Err()
+				}
+				// Nil channel is never ready, so from now on the input is only drained.
+				done = nil
+			}
+		}
+	}()
+
+	return in, errc
+}
+
+// InsertUsersDurableCopy copies users in chunks of chunkSize, committing each chunk in its own
+// transaction, so a failure loses at most one chunk. Returns the last id of the last committed
+// chunk (zero if none was committed), so the load can be resumed after it.
+func InsertUsersDurableCopy(ctx context.Context, pool *pgxpool.Pool, ids []int, chunkSize int) (int, error) {
+	if chunkSize < 1 {
+		return 0, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+
+	lastCommitted := 0
+	for start := 0; start < len(ids); start += chunkSize {
+		end := start + chunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		if err := copyUsersChunk(ctx, pool, ids[start:end]); err != nil {
+			return lastCommitted, err
+		}
+
+		lastCommitted = ids[end-1]
+	}
+
+	return lastCommitted, nil
+}
+
+func copyUsersChunk(ctx context.Context, pool *pgxpool.Pool, ids []int) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := DefaultUsers.InsertUsers(ctx, tx, ids); err != nil {
+		return fmt.Errorf("failed to copy users chunk: %w", err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit users chunk: %w", err)
+	}
+
+	return nil
+}
+
+// BulkLoadParallel splits ids into workers partitions and copies them concurrently,
+// each partition on its own connection and in its own transaction.
+// If any partition fails, the context of the others is canceled, but partitions that
+// have already committed stay committed: the load is not atomic as a whole.
+func BulkLoadParallel(ctx context.Context, pool *pgxpool.Pool, ids []int, workers int) error {
+	if workers < 1 {
+		return fmt.Errorf("invalid number of workers %d", workers)
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	size := (len(ids) + workers - 1) / workers
+	for start := 0; start < len(ids); start += size {
+		end := start + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		part := ids[start:end]
+		g.Go(func() error {
+			return copyUsersChunk(ctx, pool, part)
+		})
+	}
+
+	return g.Wait()
+}
+
+// chanSource is a pgx.CopyFromSource reading user ids from a channel.
+type chanSource struct {
+	ctx context.Context
+	in  <-chan int
+	id  int
+	err error
+}
+
+func (s *chanSource) Next() bool {
+	select {
+	case id, ok := <-s.in:
+		if !ok {
+			return false
+		}
+		s.id = id
+		return true
+	case <-s.ctx.Done():
+		s.err = s.ctx.Err()
+		return false
+	}
+}
+
+func (s *chanSource) Values() ([]interface{}, error) {
+	return []interface{}{s.id, DefaultUserName(s.id)}, nil
+}
+
+func (s *chanSource) Err() error {
+	return s.err
+}
+
+// InsertUsersFromChan copies users with ids received from in while they are being produced,
+// without buffering them all. Closing in ends the copy, canceling ctx aborts it with an error.
+// Returns number of inserted users.
+func InsertUsersFromChan(ctx context.Context, tx pgx.Tx, in <-chan int) (int64, error) {
+	src := &chanSource{ctx: ctx, in: in}
+
+	n, err := tx.CopyFrom(ctx, pgx.Identifier{"test", "users"}, []string{"id", "name"}, src)
+	if err != nil {
+		return 0, MapError(fmt.Errorf("failed to copy users: %w", err))
+	}
+
+	return n, nil
+}
@@ -0,0 +1,201 @@
+package pgperf_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"pgperf"
+)
+
+func TestStartUserIngester(t *testing.T) {
+	requireDB(t)
+
+	const (
+		firstID = 3000001
+		count   = 10000
+	)
+
+	cleanup := func() {
+		if _, err := pool.Exec(ctx, "delete from test.users where id between $1 and $2", firstID, firstID+count-1); err != nil {
+			t.Fatalf("failed to delete ingested users: %v", err)
+		}
+	}
+	cleanup()
+	t.Cleanup(cleanup)
+
+	in, errc := pgperf.StartUserIngester(ctx, pool, 100)
+	for i := 0; i < count; i++ {
+		in <- pgperf.User{ID: firstID + i, Name: fmt.Sprintf("user %d", firstID+i)}
+	}
+	close(in)
+
+	if err := <-errc; err != nil {
+		t.Fatalf("ingester failed: %v", err)
+	}
+
+	var n int
+	if err := pool.QueryRow(ctx, "select count(*) from test.users where id between $1 and $2", firstID, firstID+count-1).Scan(&n); err != nil {
+		t.Fatalf("failed to count ingested users: %v", err)
+	}
+
+	if n != count {
+		t.Fatalf("expected %d ingested users, got %d", count, n)
+	}
+}
+
+func TestStartUserIngesterCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	in, errc := pgperf.StartUserIngester(ctx, pool, 10)
+
+	// Producer must not block on a full buffer after cancellation.
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 0; i < 1000; i++ {
+			in <- pgperf.User{ID: i, Name: "canceled"}
+		}
+		close(in)
+	}()
+
+	select {
+	case <-sent:
+	case <-time.After(5 * time.Second):
+		t.Fatal("producer is blocked after cancellation")
+	}
+
+	if err := <-errc; err == nil {
+		t.Fatal("expected cancellation error")
+	}
+}
+
+func TestInsertUsersDurableCopy(t *testing.T) {
+	requireDB(t)
+
+	const (
+		firstID = 3100001
+		count   = 250
+	)
+
+	cleanup := func() {
+		if _, err := pool.Exec(ctx, "delete from test.users where id between $1 and $2", firstID, firstID+count-1); err != nil {
+			t.Fatalf("failed to delete copied users: %v", err)
+		}
+	}
+	cleanup()
+	t.Cleanup(cleanup)
+
+	ids := make([]int, count)
+	for i := range ids {
+		ids[i] = firstID + i
+	}
+
+	last, err := pgperf.InsertUsersDurableCopy(ctx, pool, ids, 100)
+	if err != nil {
+		t.Fatalf("failed to copy users: %v", err)
+	}
+
+	if last != ids[len(ids)-1] {
+		t.Fatalf("expected last committed id %d, got %d", ids[len(ids)-1], last)
+	}
+
+	var n int
+	if err := pool.QueryRow(ctx, "select count(*) from test.users where id between $1 and $2", firstID, firstID+count-1).Scan(&n); err != nil {
+		t.Fatalf("failed to count copied users: %v", err)
+	}
+
+	if n != count {
+		t.Fatalf("expected %d copied users, got %d", count, n)
+	}
+}
+
+func BenchmarkBulkLoadParallel(b *testing.B) {
+	const (
+		firstID = 4000001
+		count   = 100 * batchSize
+	)
+
+	ids := make([]int, count)
+	for i := range ids {
+		ids[i] = firstID + i
+	}
+
+	cleanup := func(b *testing.B) {
+		if _, err := pool.Exec(ctx, "delete from test.users where id between $1 and $2", firstID, firstID+count-1); err != nil {
+			b.Fatalf("failed to delete loaded users: %v", err)
+		}
+	}
+
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers-%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				cleanup(b)
+				b.StartTimer()
+
+				if err := pgperf.BulkLoadParallel(ctx, pool, ids, workers); err != nil {
+					b.Fatalf("failed to load users: %v", err)
+				}
+			}
+
+			b.StopTimer()
+			cleanup(b)
+		})
+	}
+}
+
+func TestInsertUsersFromChan(t *testing.T) {
+	tx := testTx(t)
+
+	const (
+		firstID = 4600001
+		count   = 100000
+	)
+
+	in := make(chan int)
+	go func() {
+		defer close(in)
+		for id := firstID; id < firstID+count; id++ {
+			in <- id
+		}
+	}()
+
+	n, err := pgperf.InsertUsersFromChan(ctx, tx, in)
+	if err != nil {
+		t.Fatalf("failed to insert users: %v", err)
+	}
+
+	if n != count {
+		t.Fatalf("expected %d users inserted, got %d", count, n)
+	}
+
+	var cnt int64
+	q := "select count(*) from test.users where id between $1 and $2"
+	if err := tx.QueryRow(ctx, q, firstID, firstID+count-1).Scan(&cnt); err != nil {
+		t.Fatalf("failed to count users: %v", err)
+	}
+
+	if cnt != count {
+		t.Fatalf("expected %d users, got %d", count, cnt)
+	}
+}
+
+func TestInsertUsersFromChanCanceled(t *testing.T) {
+	tx := testTx(t)
+
+	ctx, cancel := context.WithCancel(ctx)
+	in := make(chan int)
+	go func() {
+		in <- 4600001
+		cancel()
+	}()
+
+	// in is never closed, so only cancellation can end the copy.
+	if _, err := pgperf.InsertUsersFromChan(ctx, tx, in); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package pgperf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// AnomalyKind is a concurrency anomaly that isolation levels may or may not prevent.
+type AnomalyKind int
+
+const (
+	// DirtyRead is reading uncommitted changes of another transaction.
+	// PostgreSQL never allows it, even in Read Uncommitted.
+	DirtyRead AnomalyKind = iota
+	// NonRepeatableRead is getting a different value when reading the same row twice.
+	NonRepeatableRead
+	// Phantom is getting a different set of rows when running the same query twice.
+	Phantom
+	// WriteSkew is two transactions each reading an overlapping set of rows and updating
+	// different rows, so that the result could not happen with any serial order.
+	WriteSkew
+)
+
+func (k AnomalyKind) String() string {
+	switch k {
+	case DirtyRead:
+		return "dirty read"
+	case NonRepeatableRead:
+		return "non-repeatable read"
+	case Phantom:
+		return "phantom"
+	case WriteSkew:
+		return "write skew"
+	}
+
+	return fmt.Sprintf("AnomalyKind(%d)", int(k))
+}
+
+// RunAtIsolation runs fn in a transaction at isolation level like WithTx does.
+// Note that at RepeatableRead and Serializable concurrent updates of the same rows
+// fail with ErrSerializationFailure instead of waiting, and such transactions have to be retried.
+func RunAtIsolation(ctx context.Context, pool *pgxpool.Pool, level pgx.TxIsoLevel, fn func(pgx.Tx) error) error {
+	return withTxOptions(ctx, pool, pgx.TxOptions{IsoLevel: level}, fn)
+}
+
+// DemoAnomaly tries to trigger anomaly between two transactions running at iso level
+// and reports whether it occurred. It uses test.anomaly table, resetting it beforehand.
+// Transactions are interleaved step by step on two connections, so the result is deterministic.
+func DemoAnomaly(ctx context.Context, pool *pgxpool.Pool, iso pgx.TxIsoLevel, anomaly AnomalyKind) (bool, error) {
+	if err := resetAnomalyTable(ctx, pool); err != nil {
+		return false, err
+	}
+
+	conn1, err := pool.Acquire(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn1.Release()
+
+	conn2, err := pool.Acquire(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn2.Release()
+
+	tx1, err := conn1.BeginTx(ctx, pgx.TxOptions{IsoLevel: iso})
+	if err != nil {
+		return false, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx1.Rollback(ctx)
+
+	tx2, err := conn2.BeginTx(ctx, pgx.TxOptions{IsoLevel: iso})
+	if err != nil {
+		return false, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx2.Rollback(ctx)
+
+	switch anomaly {
+	case DirtyRead:
+		return demoDirtyRead(ctx, tx1, tx2)
+	case NonRepeatableRead:
+		return demoNonRepeatableRead(ctx, tx1, tx2)
+	case Phantom:
+		return demoPhantom(ctx, tx1, tx2)
+	case WriteSkew:
+		return demoWriteSkew(ctx, pool, tx1, tx2)
+	}
+
+	return false, fmt.Errorf("unknown anomaly %v", anomaly)
+}
+
+func resetAnomalyTable(ctx context.Context, pool *pgxpool.Pool) error {
+	return WithTx(ctx, pool, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, "delete from test.anomaly"); err != nil {
+			return fmt.Errorf("failed to reset anomaly table: %w", err)
+		}
+
+		if _, err := tx.Exec(ctx, "insert into test.anomaly(id, value) values (1, 1), (2, 1)"); err != nil {
+			return fmt.Errorf("failed to reset anomaly table: %w", err)
+		}
+
+		return nil
+	})
+}
+
+func readAnomalyValue(ctx context.Context, tx pgx.Tx, q string) (int, error) {
+	var v int
+	if err := tx.QueryRow(ctx, q).Scan(&v); err != nil {
+		return 0, fmt.Errorf("failed to read value: %w", err)
+	}
+
+	return v, nil
+}
+
+func demoDirtyRead(ctx context.Context, tx1, tx2 pgx.Tx) (bool, error) {
+	if _, err := tx2.Exec(ctx, "update test.anomaly set value = 100 where id = 1"); err != nil {
+		return false, fmt.Errorf("failed to update value: %w", err)
+	}
+
+	v, err := readAnomalyValue(ctx, tx1, "select value from test.anomaly where id = 1")
+	if err != nil {
+		return false, err
+	}
+
+	return v == 100, nil
+}
+
+func demoNonRepeatableRead(ctx context.Context, tx1, tx2 pgx.Tx) (bool, error) {
+	const q = "select value from test.anomaly where id = 1"
+	before, err := readAnomalyValue(ctx, tx1, q)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := tx2.Exec(ctx, "update test.anomaly set value = value + 1 where id = 1"); err != nil {
+		return false, fmt.Errorf("failed to update value: %w", err)
+	}
+
+	if err := tx2.Commit(ctx); err != nil {
+		return false, fmt.Errorf("failed to commit: %w", err)
+	}
+
+	after, err := readAnomalyValue(ctx, tx1, q)
+	if err != nil {
+		return false, err
+	}
+
+	return before != after, nil
+}
+
+func demoPhantom(ctx context.Context, tx1, tx2 pgx.Tx) (bool, error) {
+	const q = "select count(*) from test.anomaly where value > 0"
+	before, err := readAnomalyValue(ctx, tx1, q)
+	if err != nil {
+		return false, err
+	}
+
+	if _, err := tx2.Exec(ctx, "insert into test.anomaly(id, value) values (3, 1)"); err != nil {
+		return false, fmt.Errorf("failed to insert row: %w", err)
+	}
+
+	if err := tx2.Commit(ctx); err != nil {
+		return false, fmt.Errorf("failed to commit: %w", err)
+	}
+
+	after, err := readAnomalyValue(ctx, tx1, q)
+	if err != nil {
+		return false, err
+	}
+
+	return before != after, nil
+}
+
+// demoWriteSkew models two doctors on call (rows 1 and 2 with value 1). Each of them
+// checks that somebody else is still on call and goes off call. Both succeed
+// unless the database detects the conflict, leaving nobody on call.
+func demoWriteSkew(ctx context.Context, pool *pgxpool.Pool, tx1, tx2 pgx.Tx) (bool, error) {
+	const q = "select sum(value) from test.anomaly"
+	for _, tx := range []pgx.Tx{tx1, tx2} {
+		onCall, err := readAnomalyValue(ctx, tx, q)
+		if err != nil {
+			return false, err
+		}
+
+		if onCall < 2 {
+			return false, errors.New("expected both rows to be on call")
+		}
+	}
+
+	for i, tx := range []pgx.Tx{tx1, tx2} {
+		if _, err := tx.Exec(ctx, "update test.anomaly set value = 0 where id = $1", i+1); err != nil {
+			if errors.Is(MapError(err), ErrSerializationFailure) {
+				return false, nil
+			}
+			return false, fmt.Errorf("failed to update value: %w", err)
+		}
+	}
+
+	for _, tx := range []pgx.Tx{tx1, tx2} {
+		if err := tx.Commit(ctx); err != nil {
+			if errors.Is(MapError(err), ErrSerializationFailure) {
+				return false, nil
+			}
+			return false, fmt.Errorf("failed to commit: %w", err)
+		}
+	}
+
+	var onCall int
+	if err := pool.QueryRow(ctx, q).Scan(&onCall); err != nil {
+		return false, fmt.Errorf("failed to read value: %w", err)
+	}
+
+	return onCall == 0, nil
+}
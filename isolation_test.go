@@ -0,0 +1,93 @@
+package pgperf_test
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	"pgperf"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+	"golang.org/x/sync/errgroup"
+)
+
+func TestDemoAnomaly(t *testing.T) {
+	requireDB(t)
+
+	cases := []struct {
+		iso      pgx.TxIsoLevel
+		anomaly  pgperf.AnomalyKind
+		possible bool
+	}{
+		{pgx.ReadUncommitted, pgperf.DirtyRead, false},
+		{pgx.ReadCommitted, pgperf.NonRepeatableRead, true},
+		{pgx.RepeatableRead, pgperf.NonRepeatableRead, false},
+		{pgx.ReadCommitted, pgperf.Phantom, true},
+		{pgx.RepeatableRead, pgperf.Phantom, false},
+		{pgx.RepeatableRead, pgperf.WriteSkew, true},
+		{pgx.Serializable, pgperf.WriteSkew, false},
+	}
+
+	for _, c := range cases {
+		occurred, err := pgperf.DemoAnomaly(ctx, pool, c.iso, c.anomaly)
+		if err != nil {
+			t.Fatalf("failed to demo %v under %s: %v", c.anomaly, c.iso, err)
+		}
+
+		if occurred != c.possible {
+			t.Errorf("%v under %s: expected occurred=%v, got %v", c.anomaly, c.iso, c.possible, occurred)
+		}
+	}
+}
+
+func TestRunAtIsolation(t *testing.T) {
+	requireDB(t)
+
+	ids := idrtAccounts(t, pool, 3)
+
+	conn, err := getConn(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	for _, level := range []pgx.TxIsoLevel{pgx.ReadCommitted, pgx.RepeatableRead, pgx.Serializable} {
+		var failed atomic.Int64
+		err := pgperf.AssertConserved(ctx, conn, "IDRT", func() error {
+			g, ctx := errgroup.WithContext(ctx)
+			for i := 0; i < 4; i++ {
+				i := i
+				g.Go(func() error {
+					for j := 0; j < 20; j++ {
+						from, to := ids[(i+j)%len(ids)], ids[(i+j+1)%len(ids)]
+						err := pgperf.RunAtIsolation(ctx, pool, level, func(tx pgx.Tx) error {
+							_, err := pgperf.TransferLock(ctx, tx, from, to, decimal.NewFromInt(1))
+							return err
+						})
+						if errors.Is(pgperf.MapError(err), pgperf.ErrSerializationFailure) {
+							failed.Add(1)
+							continue
+						}
+						if err != nil {
+							return err
+						}
+					}
+
+					return nil
+				})
+			}
+
+			return g.Wait()
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", level, err)
+		}
+
+		if level == pgx.ReadCommitted && failed.Load() > 0 {
+			t.Fatalf("%s: expected no serialization failures, got %d", level, failed.Load())
+		}
+
+		t.Logf("%s: %d serialization failures", level, failed.Load())
+	}
+}
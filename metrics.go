@@ -0,0 +1,117 @@
+package pgperf
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Collector receives measurements of every finished query: name of the function that made it
+// (e.g. "GetUsers1" for functions of this package), number of rows and query latency.
+type Collector interface {
+	Observe(function string, rows int, latency time.Duration)
+}
+
+// WithCollector makes every query, batched query and copy on pool connections report to c.
+// It shares the pgx tracer with WithTracer, so both can be used together.
+// Pools created without it have no tracer and pay nothing for metrics.
+func WithCollector(c Collector) PoolOption {
+	return func(cfg *pgxpool.Config) {
+		queryTracerOf(cfg).collector = c
+	}
+}
+
+// callerName returns name of the function that made the query being traced:
+// the innermost function on the stack that is not a part of pgx, runtime or the tracer.
+// The name is relative to this package for its own functions.
+func callerName() string {
+	pc := make([]uintptr, 32)
+	frames := runtime.CallersFrames(pc[:runtime.Callers(2, pc)])
+	for {
+		f, more := frames.Next()
+		if !strings.HasPrefix(f.Function, "github.com/jackc/pgx/") &&
+			!strings.HasPrefix(f.Function, "runtime.") &&
+			!strings.HasPrefix(f.Function, "pgperf.(*queryTracer)") {
+			return strings.TrimPrefix(f.Function, "pgperf.")
+		}
+
+		if !more {
+			return ""
+		}
+	}
+}
+
+// LatencyBuckets are upper bounds of Metrics latency histogram buckets.
+// Latencies above the last bound go to an extra overflow bucket.
+var LatencyBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+// FunctionStats are accumulated measurements of queries made by a single function.
+type FunctionStats struct {
+	Queries int64
+	Rows    int64
+	// Latency has a count of queries per LatencyBuckets bucket, plus the overflow bucket.
+	Latency      []int64
+	TotalLatency time.Duration
+}
+
+// Metrics is a Collector that accumulates FunctionStats in memory.
+type Metrics struct {
+	mu    sync.Mutex
+	stats map[string]*FunctionStats
+}
+
+// Observe implements Collector.
+func (m *Metrics) Observe(function string, rows int, latency time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.stats == nil {
+		m.stats = make(map[string]*FunctionStats)
+	}
+
+	s, ok := m.stats[function]
+	if !ok {
+		s = &FunctionStats{Latency: make([]int64, len(LatencyBuckets)+1)}
+		m.stats[function] = s
+	}
+
+	s.Queries++
+	s.Rows += int64(rows)
+	s.TotalLatency += latency
+
+	bucket := len(LatencyBuckets)
+	for i, bound := range LatencyBuckets {
+		if latency <= bound {
+			bucket = i
+			break
+		}
+	}
+
+	s.Latency[bucket]++
+}
+
+// Snapshot returns a copy of current stats by function name.
+func (m *Metrics) Snapshot() map[string]FunctionStats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := make(map[string]FunctionStats, len(m.stats))
+	for name, s := range m.stats {
+		cp := *s
+		cp.Latency = append([]int64(nil), s.Latency...)
+		res[name] = cp
+	}
+
+	return res
+}
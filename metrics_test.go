@@ -0,0 +1,81 @@
+package pgperf_test
+
+import (
+	"testing"
+	"time"
+
+	"pgperf"
+)
+
+func TestMetricsObserve(t *testing.T) {
+	var m pgperf.Metrics
+	m.Observe("f", 10, 3*time.Millisecond)
+	m.Observe("f", 5, time.Hour)
+
+	s := m.Snapshot()["f"]
+	if s.Queries != 2 || s.Rows != 15 {
+		t.Fatalf("unexpected stats %+v", s)
+	}
+
+	if s.Latency[1] != 1 || s.Latency[len(pgperf.LatencyBuckets)] != 1 {
+		t.Fatalf("unexpected latency histogram %v", s.Latency)
+	}
+}
+
+func TestMetricsGetUsers(t *testing.T) {
+	requireDB(t)
+
+	var m pgperf.Metrics
+	p, err := pgperf.NewTunedPool(ctx, connString, pgperf.WithCollector(&m))
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer p.Close()
+
+	tx, err := p.Begin(ctx)
+	if err != nil {
+		t.Fatalf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	ids := []int{1, 2, 3, 4, 5}
+	if _, err := pgperf.GetUsers1(ctx, tx, ids); err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	if _, err := pgperf.GetUsers4(ctx, tx, ids); err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	newIDs := []int{3800011, 3800012, 3800013}
+	if err := pgperf.InsertUsers1(ctx, tx, newIDs); err != nil {
+		t.Fatalf("failed to insert users: %v", err)
+	}
+
+	// Failed call counts only queries that were really made.
+	if _, err := pgperf.GetUsers2(ctx, tx, []int{1, -1, 2}); err == nil {
+		t.Fatal("expected error for missing user")
+	}
+
+	// Queries made outside of the package are attributed to their callers too.
+	if _, err := tx.Exec(ctx, "select 1"); err != nil {
+		t.Fatalf("failed to run query: %v", err)
+	}
+
+	s := m.Snapshot()
+	if s["GetUsers1"].Queries != int64(len(ids)) || s["GetUsers4"].Queries != 1 || s["InsertUsers1"].Queries != int64(len(newIDs)) {
+		t.Fatalf("unexpected query counts %+v", s)
+	}
+
+	if s["GetUsers1"].Rows != int64(len(ids)) || s["GetUsers4"].Rows != int64(len(ids)) || s["InsertUsers1"].Rows != int64(len(newIDs)) {
+		t.Fatalf("unexpected row counts %+v", s)
+	}
+
+	if s["GetUsers2"].Queries != 2 {
+		t.Fatalf("unexpected failed call stats %+v", s["GetUsers2"])
+	}
+
+	if s["pgperf_test.TestMetricsGetUsers"].Queries != 2 {
+		t.Fatalf("expected begin and select 1 to be attributed to the test, got %+v", s)
+	}
+}
@@ -0,0 +1,45 @@
+package pgperf
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// WaitForNotification subscribes conn to channel and blocks until a notification
+// arrives, returning its payload. Notifications are delivered to the session, so conn must
+// be dedicated to listening (it is acquired by the caller, so the pool does not hand it out
+// while waiting). Notifications sent before LISTEN is executed are not received.
+// Channel is unsubscribed before return. If that fails, the connection is closed
+// so the pool does not reuse a connection still subscribed to channel.
+func WaitForNotification(ctx context.Context, conn *pgxpool.Conn, channel string) (string, error) {
+	ident := pgx.Identifier{channel}.Sanitize()
+	if _, err := conn.Exec(ctx, "listen "+ident); err != nil {
+		return "", fmt.Errorf("failed to listen %s: %w", channel, err)
+	}
+
+	defer func() {
+		if _, err := conn.Exec(ctx, "unlisten "+ident); err != nil {
+			conn.Conn().Close(context.Background())
+		}
+	}()
+
+	n, err := conn.Conn().WaitForNotification(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to wait for notification on %s: %w", channel, err)
+	}
+
+	return n.Payload, nil
+}
+
+// Notify sends a notification to channel. It is delivered to listeners only when tx commits
+// (and not at all if it rolls back), e.g. to notify that a transfer is actually completed.
+func Notify(ctx context.Context, tx pgx.Tx, channel, payload string) error {
+	if _, err := tx.Exec(ctx, "select pg_notify($1, $2)", channel, payload); err != nil {
+		return fmt.Errorf("failed to notify %s: %w", channel, err)
+	}
+
+	return nil
+}
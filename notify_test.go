@@ -0,0 +1,66 @@
+package pgperf_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"pgperf"
+)
+
+func TestWaitForNotification(t *testing.T) {
+	requireDB(t)
+
+	conn, err := getConn(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	const channel = "transfer completed"
+	type result struct {
+		payload string
+		err     error
+	}
+
+	res := make(chan result, 1)
+	go func() {
+		payload, err := pgperf.WaitForNotification(ctx, conn, channel)
+		res <- result{payload, err}
+	}()
+
+	// Notifications sent before listener has subscribed are lost, so keep sending.
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case r := <-res:
+			if r.err != nil {
+				t.Fatalf("failed to wait for notification: %v", r.err)
+			}
+
+			if r.payload != "42" {
+				t.Fatalf("expected payload 42, got %q", r.payload)
+			}
+
+			return
+		case <-ticker.C:
+			tx, err := pool.Begin(ctx)
+			if err != nil {
+				t.Fatalf("failed to start transaction: %v", err)
+			}
+
+			if err := pgperf.Notify(ctx, tx, channel, "42"); err != nil {
+				tx.Rollback(ctx)
+				t.Fatal(err)
+			}
+
+			if err := tx.Commit(ctx); err != nil {
+				t.Fatalf("failed to commit: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package pgperf
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// WriteOutbox records an event to test.outbox and returns its id. Call it in the same
+// transaction as the change the event is about (e.g. after TransferLock), so the event
+// is published if and only if the change is committed. A separate relay process
+// then reads the outbox and delivers events to the message broker.
+func WriteOutbox(ctx context.Context, tx pgx.Tx, topic string, payload []byte) (int64, error) {
+	var id int64
+	q := "insert into test.outbox(topic, payload) values ($1, $2) returning id"
+	if err := tx.QueryRow(ctx, q, topic, payload).Scan(&id); err != nil {
+		return 0, MapError(fmt.Errorf("failed to write outbox event: %w", err))
+	}
+
+	return id, nil
+}
@@ -0,0 +1,85 @@
+package pgperf_test
+
+import (
+	"errors"
+	"testing"
+
+	"pgperf"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+func TestWriteOutbox(t *testing.T) {
+	requireDB(t)
+
+	ids := idrtAccounts(t, pool, 2)
+
+	amount := func() decimal.Decimal {
+		var amt decimal.Decimal
+		if err := pool.QueryRow(ctx, "select amount from test.accounts where id = $1", ids[0]).Scan(&amt); err != nil {
+			t.Fatalf("failed to get balance: %v", err)
+		}
+		return amt
+	}
+
+	eventExists := func(id int64) bool {
+		var exists bool
+		if err := pool.QueryRow(ctx, "select exists (select from test.outbox where id = $1)", id).Scan(&exists); err != nil {
+			t.Fatalf("failed to check outbox: %v", err)
+		}
+		return exists
+	}
+
+	// Rolled back transfer leaves neither balance change nor event.
+	before := amount()
+	var eventID int64
+	errAbort := errors.New("abort")
+	err := pgperf.WithTx(ctx, pool, func(tx pgx.Tx) error {
+		if _, err := pgperf.TransferLock(ctx, tx, ids[0], ids[1], decimal.NewFromInt(1)); err != nil {
+			return err
+		}
+
+		var err error
+		if eventID, err = pgperf.WriteOutbox(ctx, tx, "transfers", []byte(`{"amount":1}`)); err != nil {
+			return err
+		}
+
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("expected abort, got %v", err)
+	}
+
+	if eventExists(eventID) || !amount().Equal(before) {
+		t.Fatal("rolled back transfer left changes")
+	}
+
+	// Committed transfer has both.
+	err = pgperf.WithTx(ctx, pool, func(tx pgx.Tx) error {
+		if _, err := pgperf.TransferLock(ctx, tx, ids[0], ids[1], decimal.NewFromInt(1)); err != nil {
+			return err
+		}
+
+		var err error
+		eventID, err = pgperf.WriteOutbox(ctx, tx, "transfers", []byte(`{"amount":1}`))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("failed to transfer: %v", err)
+	}
+
+	t.Cleanup(func() {
+		pgperf.WithTx(ctx, pool, func(tx pgx.Tx) error {
+			if _, err := tx.Exec(ctx, "delete from test.outbox where id = $1", eventID); err != nil {
+				return err
+			}
+			_, err := pgperf.TransferLock(ctx, tx, ids[1], ids[0], decimal.NewFromInt(1))
+			return err
+		})
+	})
+
+	if !eventExists(eventID) || !amount().Equal(before.Sub(decimal.NewFromInt(1))) {
+		t.Fatal("committed transfer is missing changes")
+	}
+}
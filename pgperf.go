@@ -89,7 +89,7 @@ func GetUsers4(ctx context.Context, tx pgx.Tx, ids []int) ([]string, error) {
 func InsertUsers1(ctx context.Context, tx pgx.Tx, ids []int) error {
 	for _, id := range ids {
 		if _, err := tx.Exec(ctx, "insert into test.users(id, name) values ($1, $2)", id, fmt.Sprintf("user %d", id)); err != nil {
-			return fmt.Errorf("failed to insert user %w", err)
+			return MapError(fmt.Errorf("failed to insert user %w", err))
 		}
 	}
 
@@ -105,7 +105,7 @@ func InsertUsers2(ctx context.Context, tx pgx.Tx, ids []int) error {
 
 	_, err := tx.Exec(ctx, q[:len(q)-1])
 
-	return err
+	return MapError(err)
 }
 
 // Build one huge insert string using strings.Builder.
@@ -121,7 +121,7 @@ func InsertUsers3(ctx context.Context, tx pgx.Tx, ids []int) error {
 
 	_, err := tx.Exec(ctx, sb.String())
 
-	return err
+	return MapError(err)
 }
 
 // Build one huge insert string using strings.Builder and bind vars.
@@ -142,7 +142,7 @@ func InsertUsers4(ctx context.Context, tx pgx.Tx, ids []int) error {
 
 	_, err := tx.Exec(ctx, sb.String(), args...)
 
-	return err
+	return MapError(err)
 }
 
 // Use pgx.Batch.
@@ -156,7 +156,7 @@ func InsertUsers5(ctx context.Context, tx pgx.Tx, ids []int) error {
 	_, err := br.Exec()
 	br.Close()
 
-	return err
+	return MapError(err)
 }
 
 // Use CopyFrom.
@@ -167,55 +167,191 @@ func InsertUsers6(ctx context.Context, tx pgx.Tx, ids []int) error {
 	}
 
 	cnt, err := tx.CopyFrom(ctx, pgx.Identifier{"test", "users"}, []string{"id", "name"}, pgx.CopyFromRows(rows))
+	if err != nil {
+		return MapError(err)
+	}
+
 	if cnt != int64(len(ids)) {
 		return fmt.Errorf("expected to copy %d rows, but got %d", len(ids), cnt)
 	}
 
-	return err
+	return nil
 }
 
-func TransferLock(ctx context.Context, tx pgx.Tx, from, to int, amt decimal.Decimal) error {
+// Queries used by TransferLock.
+const (
+	// Rows are locked in id order, so two concurrent transfers between the same
+	// accounts in opposite directions can't deadlock.
+	lockAccountsQuery = `select max(case when id = $1 then amount else null end) amount_from,
+	             max(case when id = $2 then amount else null end) amount_to,
+				 count(distinct currency),
+				 coalesce(max(currency), '')
+			from (select * from test.accounts where id in($3,$4) order by id for update) x`
+	// Same as lockAccountsQuery, but with weaker `for no key update` lock.
+	lockAccountsNoKeyQuery = `select max(case when id = $1 then amount else null end) amount_from,
+	             max(case when id = $2 then amount else null end) amount_to,
+				 count(distinct currency),
+				 coalesce(max(currency), '')
+			from (select * from test.accounts where id in($3,$4) order by id for no key update) x`
+	debitQuery  = "update test.accounts set amount = amount - $1 where id = $2 returning amount"
+	creditQuery = "update test.accounts set amount = amount + $1 where id = $2 returning amount"
+)
+
+// TransferQueries returns SQL of the queries TransferLock runs, e.g. to prepare them in advance.
+func TransferQueries() []string {
+	return []string{lockAccountsQuery, debitQuery, creditQuery}
+}
+
+// TransferResult has account balances after a transfer.
+type TransferResult struct {
+	FromBalance decimal.Decimal
+	ToBalance   decimal.Decimal
+}
+
+// TransferLock moves amt between accounts locking them with `for update` and returns their new balances.
+func TransferLock(ctx context.Context, tx pgx.Tx, from, to int, amt decimal.Decimal) (TransferResult, error) {
+	return TransferLockWithOptions(ctx, tx, from, to, amt, TransferOptions{})
+}
+
+// TransferOptions change behaviour of TransferLockWithOptions.
+type TransferOptions struct {
+	// DryRun makes transfer do all checks (and take the locks) without changing balances.
+	DryRun bool
+}
+
+// TransferLockWithOptions is TransferLock with options. With DryRun it returns nil error
+// and balances accounts would have if the transfer would succeed. Accounts stay locked
+// until tx ends, like in real transfer, so dry run experiences the same contention;
+// roll tx back to release them.
+func TransferLockWithOptions(ctx context.Context, tx pgx.Tx, from, to int, amt decimal.Decimal, opts TransferOptions) (TransferResult, error) {
+	return transfer(ctx, tx, lockAccountsQuery, from, to, amt, opts)
+}
+
+// TransferNoKeyUpdate is TransferLock locking accounts `for no key update` instead of `for update`.
+// The transfer only changes amount, which is not a key column, so the weaker lock is enough
+// to serialize balance changes. Unlike `for update`, it does not block `for key share` locks,
+// which foreign key checks take, so e.g. inserting rows referencing locked accounts does not wait.
+// It is not safe if the transaction then updates or deletes a key (like accounts.id).
+func TransferNoKeyUpdate(ctx context.Context, tx pgx.Tx, from, to int, amt decimal.Decimal) (TransferResult, error) {
+	return transfer(ctx, tx, lockAccountsNoKeyQuery, from, to, amt, TransferOptions{})
+}
+
+// transfer locks accounts with lockQuery and moves amt between them.
+// Balances are returned by the updates themselves, so they are exactly the ones this transfer left.
+func transfer(ctx context.Context, tx pgx.Tx, lockQuery string, from, to int, amt decimal.Decimal, opts TransferOptions) (TransferResult, error) {
 	if from == to {
-		return errors.New("can't transfer to self")
+		return TransferResult{}, errors.New("can't transfer to self")
+	}
+
+	// Reject obviously invalid amounts before taking locks,
+	// exact scale is checked when currency is known.
+	if err := ValidateAmount(amt, maxCurrencyScale); err != nil {
+		return TransferResult{}, err
 	}
+
 	var (
 		srcAmount  decimal.Decimal
 		destAmount decimal.Decimal
 		nCurr      int
+		currency   string
 	)
-	q := `select max(case when id = $1 then amount else null end) amount_from,
-	             max(case when id = $2 then amount else null end) amount_to,
-				 count(distinct currency)
-			from (select * from test.accounts where id in($3,$4) for update) x`
-
-	if err := tx.QueryRow(ctx, q, from, to, from, to).Scan(&srcAmount, &destAmount, &nCurr); err != nil {
-		return fmt.Errorf("failed to lock accounts: %w", err)
+	if err := tx.QueryRow(ctx, lockQuery, from, to, from, to).Scan(&srcAmount, &destAmount, &nCurr, &currency); err != nil {
+		return TransferResult{}, MapError(fmt.Errorf("failed to lock accounts: %w", err))
 	}
 
 	if nCurr != 1 {
-		return errors.New("can't transfer between different currencies")
+		return TransferResult{}, errors.New("can't transfer between different currencies")
+	}
+
+	if err := ValidateAmountScale(amt, currency); err != nil {
+		return TransferResult{}, err
 	}
 
 	if srcAmount.LessThan(amt) {
-		return errors.New("not enough balance on source account")
+		return TransferResult{}, fmt.Errorf("%w on source account", ErrInsufficientFunds)
 	}
 
-	r, err := tx.Exec(ctx, "update test.accounts set amount = amount - $1 where id = $2", amt, from)
-	if err != nil {
-		return err
+	// Update would fail with numeric_value_out_of_range anyway, but this error is clearer.
+	if !fitsAmount(destAmount.Add(amt)) {
+		return TransferResult{}, fmt.Errorf("%w: destination balance %v + %v", ErrAmountOverflow, destAmount, amt)
 	}
 
-	if r.RowsAffected() != 1 {
-		return sql.ErrNoRows
+	if opts.DryRun {
+		return TransferResult{FromBalance: srcAmount.Sub(amt), ToBalance: destAmount.Add(amt)}, nil
 	}
 
-	r, err = tx.Exec(ctx, "update test.accounts set amount = amount + $1 where id = $2", amt, to)
-	if err != nil {
-		return err
+	var res TransferResult
+	if err := tx.QueryRow(ctx, debitQuery, amt, from).Scan(&res.FromBalance); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return TransferResult{}, sql.ErrNoRows
+		}
+		return TransferResult{}, mapAmountError(err)
+	}
+
+	if err := tx.QueryRow(ctx, creditQuery, amt, to).Scan(&res.ToBalance); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return TransferResult{}, sql.ErrNoRows
+		}
+		return TransferResult{}, mapAmountError(err)
+	}
+
+	return res, nil
+}
+
+// Use pgx.Batch, reading result of every statement instead of only the first one.
+// Existing users are skipped with `on conflict do nothing`, so callers can find them
+// by zero rows affected. Returns rows affected by each insert.
+func InsertUsers5Detailed(ctx context.Context, tx pgx.Tx, ids []int) ([]int64, error) {
+	var b pgx.Batch
+	for _, id := range ids {
+		b.Queue("insert into test.users(id,name) values ($1, $2) on conflict (id) do nothing", id, DefaultUserName(id))
+	}
+
+	br := tx.SendBatch(ctx, &b)
+	defer br.Close()
+
+	affected := make([]int64, len(ids))
+	for i := range ids {
+		tag, err := br.Exec()
+		if err != nil {
+			return nil, MapError(fmt.Errorf("failed to insert user %d: %w", ids[i], err))
+		}
+
+		affected[i] = tag.RowsAffected()
+	}
+
+	return affected, MapError(br.Close())
+}
+
+// Pass all values as two arrays and unnest them on the server side.
+// Unlike InsertUsers4 query text does not depend on number of rows,
+// so the same prepared statement is reused for any batch size.
+func InsertUsers9(ctx context.Context, tx pgx.Tx, ids []int) error {
+	_, err := tx.Exec(ctx, "insert into test.users(id,name) select * from unnest($1::bigint[], $2::text[])", ids, defaultUserNames(ids))
+
+	return MapError(err)
+}
+
+// Use pgx.Batch, but send it every batchLimit statements instead of queueing all of them.
+// This bounds the memory used by batch on the client side.
+func InsertUsers5Chunked(ctx context.Context, tx pgx.Tx, ids []int, batchLimit int) error {
+	if batchLimit < 1 {
+		return fmt.Errorf("invalid batch limit %d", batchLimit)
 	}
 
-	if r.RowsAffected() != 1 {
-		return sql.ErrNoRows
+	b := &pgx.Batch{}
+	for i, id := range ids {
+		b.Queue("insert into test.users(id,name) values ($1, $2)", id, DefaultUserName(id))
+		if b.Len() < batchLimit && i < len(ids)-1 {
+			continue
+		}
+
+		// Close reads results of all queued statements and returns the first error.
+		if err := tx.SendBatch(ctx, b).Close(); err != nil {
+			return MapError(err)
+		}
+
+		b = &pgx.Batch{}
 	}
 
 	return nil
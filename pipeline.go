@@ -0,0 +1,85 @@
+package pgperf
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// GetUsersBatch sends query per user in a single pgx.Batch, so there is one round trip,
+// but the server still executes every query separately.
+func GetUsersBatch(ctx context.Context, tx pgx.Tx, ids []int) ([]string, error) {
+	var b pgx.Batch
+	for _, id := range ids {
+		b.Queue("select name from test.users where id = $1", id)
+	}
+
+	br := tx.SendBatch(ctx, &b)
+	defer br.Close()
+
+	names := make([]string, 0, len(ids))
+	for range ids {
+		var name string
+		if err := br.QueryRow().Scan(&name); err != nil {
+			return nil, MapError(fmt.Errorf("failed to select user %w", err))
+		}
+
+		names = append(names, name)
+	}
+
+	return names, MapError(br.Close())
+}
+
+// GetUsersPipeline sends query per user in pipeline mode: all queries are written
+// to the connection without waiting for results, which are read afterwards.
+// Pipeline is a low level pgconn API, so it needs a raw connection: get it with
+// Conn() of *pgxpool.Conn acquired from the pool (or of a pgx.Tx to run in a transaction).
+// Users that are not found are skipped.
+func GetUsersPipeline(ctx context.Context, conn *pgx.Conn, ids []int) ([]string, error) {
+	const q = "select name from test.users where id = $1"
+
+	p := conn.PgConn().StartPipeline(ctx)
+	for _, id := range ids {
+		// Parameters and results are in text format.
+		p.SendQueryParams(q, [][]byte{[]byte(strconv.Itoa(id))}, nil, nil, nil)
+	}
+
+	if err := p.Sync(); err != nil {
+		p.Close()
+		return nil, fmt.Errorf("failed to send pipeline: %w", err)
+	}
+
+	names := make([]string, 0, len(ids))
+	for i := 0; i < len(ids); i++ {
+		res, err := p.GetResults()
+		if err != nil {
+			p.Close()
+			return nil, MapError(fmt.Errorf("failed to select user %w", err))
+		}
+
+		rr, ok := res.(*pgconn.ResultReader)
+		if !ok {
+			p.Close()
+			return nil, fmt.Errorf("unexpected pipeline result %T", res)
+		}
+
+		for rr.NextRow() {
+			names = append(names, string(rr.Values()[0]))
+		}
+
+		if _, err := rr.Close(); err != nil {
+			p.Close()
+			return nil, MapError(fmt.Errorf("failed to select user %w", err))
+		}
+	}
+
+	// Close reads the rest of the results (sync).
+	if err := p.Close(); err != nil {
+		return nil, MapError(fmt.Errorf("failed to close pipeline: %w", err))
+	}
+
+	return names, nil
+}
@@ -0,0 +1,50 @@
+package pgperf_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"pgperf"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestGetUsersPipeline(t *testing.T) {
+	tx := testTx(t)
+
+	ids := []int{1, 2, 3}
+	for name, f := range map[string]func(context.Context, pgx.Tx, []int) ([]string, error){
+		"batch":    pgperf.GetUsersBatch,
+		"pipeline": getUsersPipeline,
+	} {
+		names, err := f(ctx, tx, ids)
+		if err != nil {
+			t.Fatalf("%s: failed to get users: %v", name, err)
+		}
+
+		for i, id := range ids {
+			if expected := fmt.Sprintf("user %d", id); i >= len(names) || names[i] != expected {
+				t.Fatalf("%s: expected %q at %d, got %v", name, expected, i, names)
+			}
+		}
+	}
+
+	// Connection is back to normal mode after pipeline.
+	if _, err := pgperf.GetUsers4(ctx, tx, ids); err != nil {
+		t.Fatalf("failed to get users after pipeline: %v", err)
+	}
+}
+
+// getUsersPipeline runs GetUsersPipeline on the transaction connection.
+func getUsersPipeline(ctx context.Context, tx pgx.Tx, ids []int) ([]string, error) {
+	return pgperf.GetUsersPipeline(ctx, tx.Conn(), ids)
+}
+
+func BenchmarkGetUsersPipeline(b *testing.B) {
+	runGetUsersFunc(b, getUsersPipeline)
+}
+
+func BenchmarkGetUsersBatch(b *testing.B) {
+	runGetUsersFunc(b, pgperf.GetUsersBatch)
+}
@@ -0,0 +1,404 @@
+package pgperf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Acquirer is something that gives out connections, usually *pgxpool.Pool.
+type Acquirer interface {
+	Acquire(ctx context.Context) (*pgxpool.Conn, error)
+}
+
+// isConnError reports whether err is a connection-level failure
+// (as opposed to an error reported by the server for the query).
+func isConnError(conn *pgxpool.Conn, err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return false
+	}
+
+	return conn.Conn().IsClosed() || pgconn.SafeToRetry(err)
+}
+
+// GetUsersReliable does the same as GetUsers4 in a read only transaction, but if the
+// connection turns out to be broken (e.g. server closed it), it acquires a fresh one
+// and retries once. It is safe because the read is idempotent.
+func GetUsersReliable(ctx context.Context, pool Acquirer, ids []int) ([]string, error) {
+	names, err := getUsersReadOnly(ctx, pool, ids)
+	if errors.Is(err, errConnBroken) {
+		names, err = getUsersReadOnly(ctx, pool, ids)
+	}
+
+	return names, err
+}
+
+var errConnBroken = errors.New("connection is broken")
+
+// closeStaleTimeout limits how long AcquireHealthy waits for a stale connection to close.
+const closeStaleTimeout = time.Second
+
+// AcquireHealthy acquires a connection and pings it with `select 1`. If the ping fails
+// (e.g. connection went stale after database restart or failover), the connection is
+// closed, so the pool destroys it instead of handing it out again, and acquire is retried.
+// Returns the last error after maxAttempts failed attempts. If ctx is done, returns right away
+// without blaming the connection.
+func AcquireHealthy(ctx context.Context, pool Acquirer, maxAttempts int) (*pgxpool.Conn, error) {
+	var lastErr error
+	for i := 0; i < maxAttempts; i++ {
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			lastErr = fmt.Errorf("failed to acquire connection: %w", err)
+			if ctx.Err() != nil {
+				return nil, lastErr
+			}
+			continue
+		}
+
+		if _, err := conn.Exec(ctx, "select 1"); err != nil {
+			lastErr = fmt.Errorf("failed to ping connection: %w", err)
+			if ctx.Err() != nil {
+				conn.Release()
+				return nil, lastErr
+			}
+
+			closeCtx, cancel := context.WithTimeout(context.Background(), closeStaleTimeout)
+			conn.Conn().Close(closeCtx)
+			cancel()
+			conn.Release()
+			continue
+		}
+
+		return conn, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("invalid number of attempts %d", maxAttempts)
+	}
+
+	return nil, lastErr
+}
+
+func getUsersReadOnly(ctx context.Context, pool Acquirer, ids []int) ([]string, error) {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+	if err != nil {
+		if isConnError(conn, err) {
+			return nil, fmt.Errorf("%w: %v", errConnBroken, err)
+		}
+		return nil, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	names, err := GetUsers4(ctx, tx, ids)
+	if isConnError(conn, err) {
+		return nil, fmt.Errorf("%w: %v", errConnBroken, err)
+	}
+
+	return names, err
+}
+
+// WarmPool prepares named statements on all idle pool connections and on new connections
+// it opens up to MaxConns, so first real queries don't have to pay for parsing.
+// It only helps when queries refer to prepared statements by name (see GetUsers3),
+// i.e. in a "prepare per connection" mode. With the default QueryExecModeCacheStatement pgx
+// prepares and caches statements by SQL text on first use, unless statement name equals its text.
+// Connections acquired by others are skipped instead of waited for, so it can be called
+// in a running process; a new connection is opened only while the pool is not full, though
+// Acquire may still wait (until ctx is done) if others take the last free slots concurrently.
+// Skipped connections and connections created later (e.g. after MaxConnLifetime) are not
+// warmed up: prepare statements in AfterConnect (see PreparedStatementWarmer) to cover them.
+func WarmPool(ctx context.Context, pool *pgxpool.Pool, statements map[string]string) error {
+	conns := pool.AcquireAllIdle(ctx)
+	defer func() {
+		for _, conn := range conns {
+			conn.Release()
+		}
+	}()
+
+	// Hold all acquired connections, so every acquire opens a new one.
+	for s := pool.Stat(); s.TotalConns() < s.MaxConns(); s = pool.Stat() {
+		conn, err := pool.Acquire(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to acquire connection: %w", err)
+		}
+
+		conns = append(conns, conn)
+	}
+
+	for _, conn := range conns {
+		for name, sql := range statements {
+			if _, err := conn.Conn().Prepare(ctx, name, sql); err != nil {
+				return fmt.Errorf("failed to prepare statement %q: %w", name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// PoolOption tunes pool configuration before the pool is created.
+type PoolOption func(*pgxpool.Config)
+
+// WithQueryExecMode sets default query execution mode for all pool connections.
+func WithQueryExecMode(mode pgx.QueryExecMode) PoolOption {
+	return func(cfg *pgxpool.Config) {
+		cfg.ConnConfig.DefaultQueryExecMode = mode
+	}
+}
+
+// NewTunedPool creates connection pool with options applied on top of connString settings.
+func NewTunedPool(ctx context.Context, connString string, opts ...PoolOption) (*pgxpool.Pool, error) {
+	cfg, err := pgxpool.ParseConfig(connString)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse pool config: %w", err)
+	}
+
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	return pgxpool.NewWithConfig(ctx, cfg)
+}
+
+// WithConn acquires a connection, runs fn with it and releases it, so all queries made by fn
+// use the same session. This is needed for session state: temporary tables, session
+// advisory locks, `set` (without `local`) and so on. fn must not keep conn after it returns.
+// Note that session state stays on the connection when it goes back to the pool.
+func WithConn(ctx context.Context, pool *pgxpool.Pool, fn func(conn *pgxpool.Conn) error) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	return fn(conn)
+}
+
+// WithTx acquires a connection, runs fn in a transaction and commits it if fn succeeds
+// or rolls it back if fn returns an error (or panics). Connection is released in all cases.
+func WithTx(ctx context.Context, pool *pgxpool.Pool, fn func(tx pgx.Tx) error) error {
+	return withTx(ctx, pool, fn)
+}
+
+func withTx(ctx context.Context, pool Acquirer, fn func(tx pgx.Tx) error) error {
+	return withTxOptions(ctx, pool, pgx.TxOptions{}, fn)
+}
+
+func withTxOptions(ctx context.Context, pool Acquirer, opts pgx.TxOptions, fn func(tx pgx.Tx) error) error {
+	conn, err := pool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to acquire connection: %w", err)
+	}
+	defer conn.Release()
+
+	tx, err := conn.BeginTx(ctx, opts)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback(ctx)
+			panic(p)
+		}
+	}()
+
+	if err := fn(tx); err != nil {
+		if rbErr := tx.Rollback(ctx); rbErr != nil && !errors.Is(rbErr, pgx.ErrTxClosed) {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rbErr)
+		}
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// RunWithRetry runs fn in a transaction with WithTx and retries it (at most maxRetries times)
+// if it fails with ErrSerializationFailure or ErrDeadlock. Such failures are expected under
+// concurrency and a retry in a new transaction usually succeeds. fn must be safe to re-run.
+func RunWithRetry(ctx context.Context, pool *pgxpool.Pool, fn func(tx pgx.Tx) error, maxRetries int) error {
+	for i := 0; ; i++ {
+		err := MapError(WithTx(ctx, pool, fn))
+		if err == nil || i >= maxRetries || ctx.Err() != nil ||
+			!(errors.Is(err, ErrSerializationFailure) || errors.Is(err, ErrDeadlock)) {
+			return err
+		}
+	}
+}
+
+// RunWithReconnect runs fn in a transaction like WithTx and retries it (at most maxRetries times)
+// on connection-level failures that happened before anything was sent to the server
+// (see pgconn.SafeToRetry), e.g. when the pool gave out a connection closed by a network blip.
+// Business and query errors are returned as is.
+func RunWithReconnect(ctx context.Context, pool Acquirer, fn func(tx pgx.Tx) error, maxRetries int) error {
+	for i := 0; ; i++ {
+		err := withTx(ctx, pool, fn)
+		if err == nil || i >= maxRetries || ctx.Err() != nil || !safeToRetry(err) {
+			return err
+		}
+	}
+}
+
+// safeToRetry is pgconn.SafeToRetry that also looks into wrapped errors.
+func safeToRetry(err error) bool {
+	var r interface{ SafeToRetry() bool }
+
+	return errors.As(err, &r) && r.SafeToRetry()
+}
+
+// WithStatementTimeout sets statement_timeout for all pool connections, so a runaway
+// query is canceled by the server (MapError classifies this as ErrQueryCanceled).
+// Zero disables the timeout, sub-millisecond timeouts are rounded up to 1ms.
+// Panics if d is negative.
+func WithStatementTimeout(d time.Duration) PoolOption {
+	if d < 0 {
+		panic(fmt.Sprintf("invalid statement timeout %v", d))
+	}
+
+	return func(cfg *pgxpool.Config) {
+		cfg.ConnConfig.RuntimeParams["statement_timeout"] = timeoutMillis(d)
+	}
+}
+
+// SetStatementTimeout sets statement_timeout until the end of the transaction
+// (as `set local` does). Zero disables the timeout, sub-millisecond timeouts
+// are rounded up to 1ms.
+func SetStatementTimeout(ctx context.Context, tx pgx.Tx, d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("invalid statement timeout %v", d)
+	}
+
+	// set does not support bind parameters, set_config does.
+	_, err := tx.Exec(ctx, "select set_config('statement_timeout', $1, true)", timeoutMillis(d))
+	if err != nil {
+		return fmt.Errorf("failed to set statement timeout: %w", err)
+	}
+
+	return nil
+}
+
+// timeoutMillis formats d as a timeout setting value in milliseconds. It rounds up,
+// so that a short timeout does not become zero, which means no timeout in Postgres.
+func timeoutMillis(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Millisecond-1)/time.Millisecond), 10)
+}
+
+// QueryRowTimeout is tx.QueryRow cancelled if it does not finish in d (including Scan).
+// When the timeout fires, pgx cancels the query on the server and closes the connection,
+// so tx can only be rolled back (Rollback does not block on the dead connection)
+// and the pool replaces the connection when it is released.
+// Scan returns an error wrapping context.DeadlineExceeded in this case.
+// The returned row must always be scanned: Scan releases the timeout context,
+// a row that is dropped keeps it (and its timer) until d expires.
+func QueryRowTimeout(ctx context.Context, tx pgx.Tx, d time.Duration, sql string, args ...interface{}) pgx.Row {
+	ctx, cancel := context.WithTimeout(ctx, d)
+
+	return &timeoutRow{row: tx.QueryRow(ctx, sql, args...), ctx: ctx, cancel: cancel}
+}
+
+// timeoutRow releases context of QueryRowTimeout when row is scanned.
+// It is the only place cancel is called, so callers have to call Scan.
+type timeoutRow struct {
+	row    pgx.Row
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (r *timeoutRow) Scan(dest ...interface{}) error {
+	defer r.cancel()
+
+	err := r.row.Scan(dest...)
+	if err != nil && errors.Is(r.ctx.Err(), context.DeadlineExceeded) && !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%v: %w", err, r.ctx.Err())
+	}
+
+	return err
+}
+
+// PreparedStatementWarmer prepares queries on every new pool connection (in AfterConnect hook),
+// so no request pays for preparing them on a cold connection.
+// Statements are named after their SQL text: pgx looks up prepared statements by query text
+// first, so queries with exactly the same text use them regardless of the exec mode.
+func PreparedStatementWarmer(queries []string) PoolOption {
+	return func(cfg *pgxpool.Config) {
+		next := cfg.AfterConnect
+		cfg.AfterConnect = func(ctx context.Context, conn *pgx.Conn) error {
+			if next != nil {
+				if err := next(ctx, conn); err != nil {
+					return err
+				}
+			}
+
+			for _, q := range queries {
+				if _, err := conn.Prepare(ctx, q, q); err != nil {
+					return fmt.Errorf("failed to prepare %q: %w", q, err)
+				}
+			}
+
+			return nil
+		}
+	}
+}
+
+// StatsSnapshot is a point in time copy of connection pool statistics.
+type StatsSnapshot struct {
+	AcquiredConns int32
+	IdleConns     int32
+	TotalConns    int32
+	NewConnsCount int64
+	MaxConns      int32
+}
+
+// PoolStats returns current statistics of pool, e.g. to log them periodically
+// and see if the pool is saturated (all MaxConns are acquired).
+func PoolStats(pool *pgxpool.Pool) StatsSnapshot {
+	s := pool.Stat()
+
+	return StatsSnapshot{
+		AcquiredConns: s.AcquiredConns(),
+		IdleConns:     s.IdleConns(),
+		TotalConns:    s.TotalConns(),
+		NewConnsCount: s.NewConnsCount(),
+		MaxConns:      s.MaxConns(),
+	}
+}
+
+func (s StatsSnapshot) String() string {
+	return fmt.Sprintf("acquired %d, idle %d, total %d/%d, created %d",
+		s.AcquiredConns, s.IdleConns, s.TotalConns, s.MaxConns, s.NewConnsCount)
+}
+
+// ClosePool closes pool waiting for acquired connections to be released at most until ctx is done.
+// pool.Close blocks until all connections are released, so a stuck connection would block
+// shutdown forever. On timeout the pool keeps closing in background and ctx error is returned.
+func ClosePool(ctx context.Context, pool *pgxpool.Pool) error {
+	done := make(chan struct{})
+	go func() {
+		pool.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("failed to close pool: %w", ctx.Err())
+	}
+}
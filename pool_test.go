@@ -0,0 +1,446 @@
+package pgperf_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"pgperf"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// breakingAcquirer closes the first connection it gives out,
+// imitating connection terminated by the server.
+type breakingAcquirer struct {
+	pool   *pgxpool.Pool
+	broken bool
+}
+
+func (a *breakingAcquirer) Acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	conn, err := a.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if !a.broken {
+		a.broken = true
+		conn.Conn().Close(ctx)
+	}
+
+	return conn, nil
+}
+
+func TestGetUsersReliable(t *testing.T) {
+	requireDB(t)
+
+	a := &breakingAcquirer{pool: pool}
+	names, err := pgperf.GetUsersReliable(ctx, a, []int{1, 2, 3})
+	if err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	if !a.broken {
+		t.Fatal("expected first connection to be broken")
+	}
+
+	sort.Strings(names)
+	for i, name := range names {
+		if expected := fmt.Sprintf("user %d", i+1); name != expected {
+			t.Fatalf("expected %q, got %q", expected, name)
+		}
+	}
+
+	if len(names) != 3 {
+		t.Fatalf("expected 3 names, got %d", len(names))
+	}
+}
+
+func TestAcquireHealthy(t *testing.T) {
+	requireDB(t)
+
+	a := &breakingAcquirer{pool: pool}
+	conn, err := pgperf.AcquireHealthy(ctx, a, 2)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	if !a.broken {
+		t.Fatal("expected first connection to be broken")
+	}
+
+	if conn.Conn().IsClosed() {
+		t.Fatal("expected healthy connection")
+	}
+
+	// Single attempt gets a broken connection.
+	a = &breakingAcquirer{pool: pool}
+	if _, err := pgperf.AcquireHealthy(ctx, a, 1); err == nil {
+		t.Fatal("expected ping error")
+	}
+}
+
+func TestAcquireHealthyCanceled(t *testing.T) {
+	requireDB(t)
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+
+	a := &countingAcquirer{pool: pool}
+	if _, err := pgperf.AcquireHealthy(cctx, a, 3); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	if a.calls != 1 {
+		t.Fatalf("expected 1 acquire attempt, got %d", a.calls)
+	}
+}
+
+// countingAcquirer counts Acquire calls.
+type countingAcquirer struct {
+	pool  *pgxpool.Pool
+	calls int
+}
+
+func (a *countingAcquirer) Acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	a.calls++
+	return a.pool.Acquire(ctx)
+}
+
+func TestWarmPool(t *testing.T) {
+	requireDB(t)
+
+	err := pgperf.WarmPool(ctx, pool, map[string]string{
+		"warm_get_user": "select name from test.users where id = $1",
+	})
+	if err != nil {
+		t.Fatalf("failed to warm pool: %v", err)
+	}
+
+	conn, err := getConn(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	var name string
+	if err := conn.QueryRow(ctx, "warm_get_user", 1).Scan(&name); err != nil {
+		t.Fatalf("failed to query prepared statement: %v", err)
+	}
+
+	if name != "user 1" {
+		t.Fatalf("expected %q, got %q", "user 1", name)
+	}
+}
+
+func TestWarmPoolBusyConnection(t *testing.T) {
+	requireDB(t)
+
+	p, err := pgperf.NewTunedPool(ctx, connString, func(cfg *pgxpool.Config) { cfg.MaxConns = 2 })
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer p.Close()
+
+	busy, err := p.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer busy.Release()
+
+	// Connection held by someone else is skipped, not waited for.
+	wctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if err := pgperf.WarmPool(wctx, p, map[string]string{"warm_select": "select 1"}); err != nil {
+		t.Fatalf("failed to warm pool: %v", err)
+	}
+
+	if total := p.Stat().TotalConns(); total != 2 {
+		t.Fatalf("expected pool to open 2 connections, got %d", total)
+	}
+}
+
+func TestWithTx(t *testing.T) {
+	requireDB(t)
+
+	const committedID, rolledBackID = 3200001, 3200002
+	cleanup := func() {
+		pool.Exec(ctx, "delete from test.users where id in ($1, $2)", committedID, rolledBackID)
+	}
+	cleanup()
+	t.Cleanup(cleanup)
+
+	err := pgperf.WithTx(ctx, pool, func(tx pgx.Tx) error {
+		return pgperf.InsertUsers1(ctx, tx, []int{committedID})
+	})
+	if err != nil {
+		t.Fatalf("failed to insert user: %v", err)
+	}
+
+	errAbort := errors.New("abort")
+	err = pgperf.WithTx(ctx, pool, func(tx pgx.Tx) error {
+		if err := pgperf.InsertUsers1(ctx, tx, []int{rolledBackID}); err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("expected abort error, got %v", err)
+	}
+
+	var ids []int
+	if err := pool.QueryRow(ctx, "select array_agg(id) from test.users where id in ($1, $2)", committedID, rolledBackID).Scan(&ids); err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	if len(ids) != 1 || ids[0] != committedID {
+		t.Fatalf("expected only committed user %d, got %v", committedID, ids)
+	}
+}
+
+func TestWithConn(t *testing.T) {
+	requireDB(t)
+
+	var n int
+	err := pgperf.WithConn(ctx, pool, func(conn *pgxpool.Conn) error {
+		if _, err := conn.Exec(ctx, "create temporary table with_conn as select generate_series(1, 3) id"); err != nil {
+			return fmt.Errorf("failed to create temporary table: %w", err)
+		}
+		defer conn.Exec(ctx, "drop table if exists with_conn")
+
+		// Temporary table is visible only in the session that created it.
+		return conn.QueryRow(ctx, "select count(*) from with_conn").Scan(&n)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 3 {
+		t.Fatalf("expected 3 rows in temporary table, got %d", n)
+	}
+}
+
+func TestWithStatementTimeout(t *testing.T) {
+	requireDB(t)
+
+	p, err := pgperf.NewTunedPool(ctx, connString, pgperf.WithStatementTimeout(time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer p.Close()
+
+	_, err = p.Exec(ctx, "select pg_sleep(1)")
+	if err = pgperf.MapError(err); !errors.Is(err, pgperf.ErrQueryCanceled) {
+		t.Fatalf("expected query to be canceled, got %v", err)
+	}
+}
+
+func TestSetStatementTimeout(t *testing.T) {
+	tx := testTx(t)
+
+	if err := pgperf.SetStatementTimeout(ctx, tx, time.Millisecond); err != nil {
+		t.Fatalf("failed to set statement timeout: %v", err)
+	}
+
+	_, err := tx.Exec(ctx, "select pg_sleep(1)")
+	if err = pgperf.MapError(err); !errors.Is(err, pgperf.ErrQueryCanceled) {
+		t.Fatalf("expected query to be canceled, got %v", err)
+	}
+}
+
+func TestStatementTimeoutSubMillisecond(t *testing.T) {
+	requireDB(t)
+
+	p, err := pgperf.NewTunedPool(ctx, connString, pgperf.WithStatementTimeout(500*time.Microsecond))
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer p.Close()
+
+	_, err = p.Exec(ctx, "select pg_sleep(1)")
+	if err = pgperf.MapError(err); !errors.Is(err, pgperf.ErrQueryCanceled) {
+		t.Fatalf("expected query to be canceled, got %v", err)
+	}
+
+	tx := testTx(t)
+
+	if err := pgperf.SetStatementTimeout(ctx, tx, -time.Millisecond); err == nil {
+		t.Fatal("expected negative timeout to be rejected")
+	}
+
+	if err := pgperf.SetStatementTimeout(ctx, tx, 500*time.Microsecond); err != nil {
+		t.Fatalf("failed to set statement timeout: %v", err)
+	}
+
+	var timeout string
+	if err := tx.QueryRow(ctx, "select current_setting('statement_timeout')").Scan(&timeout); err != nil {
+		t.Fatalf("failed to get statement timeout: %v", err)
+	}
+
+	if timeout != "1ms" {
+		t.Fatalf("expected 1ms statement timeout, got %q", timeout)
+	}
+}
+
+func TestPreparedStatementWarmer(t *testing.T) {
+	requireDB(t)
+
+	queries := pgperf.TransferQueries()
+	p, err := pgperf.NewTunedPool(ctx, connString, pgperf.PreparedStatementWarmer(queries))
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer p.Close()
+
+	conn, err := p.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	// Fresh connection already has all transfer statements prepared before the first transfer.
+	var n int
+	if err := conn.QueryRow(ctx, "select count(*) from pg_prepared_statements where statement = any($1)", queries).Scan(&n); err != nil {
+		t.Fatalf("failed to get prepared statements: %v", err)
+	}
+
+	if n != len(queries) {
+		t.Fatalf("expected %d prepared statements, got %d", len(queries), n)
+	}
+}
+
+func TestRunWithRetry(t *testing.T) {
+	requireDB(t)
+
+	calls := 0
+	err := pgperf.RunWithRetry(ctx, pool, func(tx pgx.Tx) error {
+		calls++
+		if calls < 3 {
+			return pgperf.ErrSerializationFailure
+		}
+		return nil
+	}, 5)
+	if err != nil {
+		t.Fatalf("expected retries to succeed: %v", err)
+	}
+
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+
+	// Other errors are not retried.
+	errOther := errors.New("other")
+	calls = 0
+	err = pgperf.RunWithRetry(ctx, pool, func(tx pgx.Tx) error {
+		calls++
+		return errOther
+	}, 5)
+	if !errors.Is(err, errOther) || calls != 1 {
+		t.Fatalf("expected single call failed with other error, got %d calls and %v", calls, err)
+	}
+}
+
+func TestQueryRowTimeout(t *testing.T) {
+	tx := testTx(t)
+
+	var n int
+	if err := pgperf.QueryRowTimeout(ctx, tx, time.Second, "select 1").Scan(&n); err != nil || n != 1 {
+		t.Fatalf("expected fast query to succeed, got %d, %v", n, err)
+	}
+
+	err := pgperf.QueryRowTimeout(ctx, tx, 100*time.Millisecond, "select 1 from pg_sleep(5)").Scan(&n)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		tx.Rollback(ctx)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("rollback after timeout is blocked")
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	requireDB(t)
+
+	conn, err := getConn(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	s := pgperf.PoolStats(pool)
+	if s.AcquiredConns < 1 || s.TotalConns < s.AcquiredConns || s.NewConnsCount < 1 || s.MaxConns < 1 {
+		t.Fatalf("unexpected pool stats %v", s)
+	}
+}
+
+func TestClosePool(t *testing.T) {
+	requireDB(t)
+
+	p, err := pgperf.NewTunedPool(ctx, connString)
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+
+	conn, err := p.Acquire(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+
+	// Acquired connection is not released in time.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if err := pgperf.ClosePool(timeoutCtx, p); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	conn.Release()
+
+	if err := pgperf.ClosePool(ctx, p); err != nil {
+		t.Fatalf("failed to close pool: %v", err)
+	}
+}
+
+func TestRunWithReconnect(t *testing.T) {
+	requireDB(t)
+
+	// The first connection is closed, imitating a network failure.
+	a := &breakingAcquirer{pool: pool}
+	calls := 0
+	err := pgperf.RunWithReconnect(ctx, a, func(tx pgx.Tx) error {
+		calls++
+		_, err := pgperf.GetUsers4(ctx, tx, []int{1})
+		return err
+	}, 1)
+	if err != nil {
+		t.Fatalf("expected retry to succeed: %v", err)
+	}
+
+	if !a.broken || calls != 1 {
+		t.Fatalf("expected broken connection to be retried, got %d calls", calls)
+	}
+
+	// Business errors are not retried.
+	errBusiness := errors.New("business")
+	calls = 0
+	err = pgperf.RunWithReconnect(ctx, pool, func(tx pgx.Tx) error {
+		calls++
+		return errBusiness
+	}, 3)
+	if !errors.Is(err, errBusiness) || calls != 1 {
+		t.Fatalf("expected single call failed with business error, got %d calls and %v", calls, err)
+	}
+}
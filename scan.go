@@ -0,0 +1,72 @@
+package pgperf
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/shopspring/decimal"
+)
+
+// ScanMap runs query returning two columns and reads them into a map from the first
+// column to the second one. If a key occurs more than once, the last row wins.
+func ScanMap[K comparable, V any](ctx context.Context, tx pgx.Tx, sql string, args ...interface{}) (map[K]V, error) {
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, MapError(fmt.Errorf("failed to query map: %w", err))
+	}
+	defer rows.Close()
+
+	res := make(map[K]V)
+	for rows.Next() {
+		var (
+			k K
+			v V
+		)
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, fmt.Errorf("failed to scan map entry: %w", err)
+		}
+
+		res[k] = v
+	}
+
+	return res, MapError(rows.Err())
+}
+
+// ScanDecimals runs query returning a single numeric column and reads it into a slice.
+// NULLs (e.g. sum over no rows) are read as decimal.Zero, see ScanDecimalsSkipNull to skip them.
+func ScanDecimals(ctx context.Context, tx pgx.Tx, sql string, args ...interface{}) ([]decimal.Decimal, error) {
+	return scanDecimals(ctx, tx, false, sql, args...)
+}
+
+// ScanDecimalsSkipNull is ScanDecimals that leaves NULLs out of the result.
+func ScanDecimalsSkipNull(ctx context.Context, tx pgx.Tx, sql string, args ...interface{}) ([]decimal.Decimal, error) {
+	return scanDecimals(ctx, tx, true, sql, args...)
+}
+
+func scanDecimals(ctx context.Context, tx pgx.Tx, skipNull bool, sql string, args ...interface{}) ([]decimal.Decimal, error) {
+	rows, err := tx.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, MapError(fmt.Errorf("failed to query decimals: %w", err))
+	}
+	defer rows.Close()
+
+	var res []decimal.Decimal
+	for rows.Next() {
+		var d decimal.NullDecimal
+		if err := rows.Scan(&d); err != nil {
+			return nil, fmt.Errorf("failed to scan decimal: %w", err)
+		}
+
+		if !d.Valid {
+			if skipNull {
+				continue
+			}
+			d.Decimal = decimal.Zero
+		}
+
+		res = append(res, d.Decimal)
+	}
+
+	return res, MapError(rows.Err())
+}
@@ -0,0 +1,62 @@
+package pgperf_test
+
+import (
+	"fmt"
+	"testing"
+
+	"pgperf"
+)
+
+func TestScanMap(t *testing.T) {
+	tx := testTx(t)
+
+	ids := []int{1, 2, 3}
+	names, err := pgperf.ScanMap[int, string](ctx, tx, "select id, name from test.users where id = any($1)", ids)
+	if err != nil {
+		t.Fatalf("failed to scan map: %v", err)
+	}
+
+	if len(names) != len(ids) {
+		t.Fatalf("expected %d users, got %v", len(ids), names)
+	}
+
+	for _, id := range ids {
+		if names[id] != fmt.Sprintf("user %d", id) {
+			t.Fatalf("unexpected name of user %d: %q", id, names[id])
+		}
+	}
+
+	// Last row wins for duplicate keys.
+	m, err := pgperf.ScanMap[int, int](ctx, tx, "select 1, x from generate_series(1, 3) x order by x")
+	if err != nil {
+		t.Fatalf("failed to scan map: %v", err)
+	}
+
+	if len(m) != 1 || m[1] != 3 {
+		t.Fatalf("expected last value to win, got %v", m)
+	}
+}
+
+func TestScanDecimals(t *testing.T) {
+	tx := testTx(t)
+
+	q := "select x from (values (1.5::numeric, 1), (null, 2), (-2, 3)) v(x, ord) order by ord"
+
+	res, err := pgperf.ScanDecimals(ctx, tx, q)
+	if err != nil {
+		t.Fatalf("failed to scan decimals: %v", err)
+	}
+
+	if fmt.Sprint(res) != "[1.5 0 -2]" {
+		t.Fatalf("expected NULL to be read as zero, got %v", res)
+	}
+
+	res, err = pgperf.ScanDecimalsSkipNull(ctx, tx, q)
+	if err != nil {
+		t.Fatalf("failed to scan decimals: %v", err)
+	}
+
+	if fmt.Sprint(res) != "[1.5 -2]" {
+		t.Fatalf("expected NULL to be skipped, got %v", res)
+	}
+}
@@ -1,18 +1,28 @@
 drop schema if exists test cascade;
 create schema test;
 
-create table test.users (id bigint primary key, name varchar(128));
+create table test.users (
+    id bigint generated by default as identity (start with 2000001) primary key,
+    name varchar(128)
+);
 
 insert into test.users(id,name)
     select g, 'user ' || g::varchar
     from generate_series(1,1000000) g;
 
+-- Prefix search (`like 'abc%'`) can use a btree index only with pattern ops
+-- (or if database collation is C).
+create index users_name_pattern_i on test.users(name text_pattern_ops);
+
+create table test.users_archive (id bigint primary key, name varchar(128));
+
 
 create table test.accounts (
     id bigserial primary key,
     user_id bigint references test.users(id),
     currency varchar(4),
-    amount numeric
+    amount numeric,
+    last_credited date
 );
 
 insert into test.accounts (user_id, currency, amount)
@@ -34,3 +44,29 @@ insert into test.idr_rate(currency, rate) values
 ('BTC', 317000000),
 ('ETH', 23000000),
 ('PTU', 6000);
+
+
+-- Scratch table for isolation level demos.
+create table test.anomaly (id int primary key, value int);
+
+
+create table test.transfer_log (
+    id bigserial primary key,
+    key text unique,
+    from_id bigint not null,
+    to_id bigint not null,
+    amount numeric not null,
+    created_at timestamptz not null default now()
+);
+
+create index transfer_log_from_id_i on test.transfer_log(from_id, created_at);
+create index transfer_log_to_id_i on test.transfer_log(to_id, created_at);
+
+
+-- Events written in the same transaction as changes they describe (transactional outbox).
+create table test.outbox (
+    id bigserial primary key,
+    topic text not null,
+    payload bytea not null,
+    created_at timestamptz not null default now()
+);
@@ -0,0 +1,35 @@
+package pgperf
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Tenant routes users queries to the tenant's own schema (e.g. tenant1.users).
+// Table name is qualified explicitly instead of relying on search_path,
+// so a query can never silently fall through to another tenant's table.
+type Tenant struct {
+	ID int
+}
+
+// Schema returns name of the tenant's schema.
+func (t Tenant) Schema() string {
+	return fmt.Sprintf("tenant%d", t.ID)
+}
+
+// Users returns the tenant's users table.
+func (t Tenant) Users() Users {
+	return Users{Schema: t.Schema(), Table: "users"}
+}
+
+// GetUsers returns names of tenant's users with given ids (see GetUsers4).
+func (t Tenant) GetUsers(ctx context.Context, tx pgx.Tx, ids []int) ([]string, error) {
+	return t.Users().GetUsers(ctx, tx, ids)
+}
+
+// InsertUsers inserts tenant's users with given ids (see InsertUsers6).
+func (t Tenant) InsertUsers(ctx context.Context, tx pgx.Tx, ids []int) error {
+	return t.Users().InsertUsers(ctx, tx, ids)
+}
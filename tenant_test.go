@@ -0,0 +1,49 @@
+package pgperf_test
+
+import (
+	"testing"
+
+	"pgperf"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestTenantIsolation(t *testing.T) {
+	tx := testTx(t)
+
+	tenant1 := pgperf.Tenant{ID: 900001}
+	tenant2 := pgperf.Tenant{ID: 900002}
+	for _, tenant := range []pgperf.Tenant{tenant1, tenant2} {
+		schema := pgx.Identifier{tenant.Schema()}.Sanitize()
+		if _, err := tx.Exec(ctx, "create schema "+schema); err != nil {
+			t.Fatalf("failed to create schema: %v", err)
+		}
+
+		if _, err := tx.Exec(ctx, "create table "+schema+".users (id bigint primary key, name varchar(128))"); err != nil {
+			t.Fatalf("failed to create users table: %v", err)
+		}
+	}
+
+	if err := tenant1.InsertUsers(ctx, tx, []int{1, 2}); err != nil {
+		t.Fatalf("failed to insert tenant1 users: %v", err)
+	}
+
+	if err := tenant2.InsertUsers(ctx, tx, []int{3, 4}); err != nil {
+		t.Fatalf("failed to insert tenant2 users: %v", err)
+	}
+
+	names, err := tenant1.GetUsers(ctx, tx, []int{1, 2, 3, 4})
+	if err != nil {
+		t.Fatalf("failed to get tenant1 users: %v", err)
+	}
+
+	if len(names) != 2 {
+		t.Fatalf("expected 2 tenant1 users, got %v", names)
+	}
+
+	for _, name := range names {
+		if name != "user 1" && name != "user 2" {
+			t.Fatalf("tenant1 sees foreign user %q", name)
+		}
+	}
+}
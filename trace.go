@@ -0,0 +1,198 @@
+package pgperf
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Span describes a finished query or a finished operation (see Traced) traced by WithTracer.
+type Span struct {
+	// Operation is a name of operation given to Traced, e.g. "GetUsers4".
+	// It is empty for queries made outside of Traced calls.
+	Operation string
+	// SQL is the query text, or text of the first query made by the operation.
+	SQL string
+	// Queries is the number of queries made by the operation (1 for a single query).
+	Queries  int64
+	Rows     int64
+	Duration time.Duration
+	Err      error
+}
+
+// Tracer receives spans of finished queries. It is small enough to be adapted
+// to OpenTelemetry or any other tracing library without depending on it here
+// (span start time is time.Now() minus Duration).
+type Tracer interface {
+	TraceQuery(ctx context.Context, span Span)
+}
+
+// WithTracer makes every query, batched query and copy on pool connections report a Span to t,
+// or, if it is made within Traced, contribute to the span of the operation.
+// It replaces a tracer already set in the connection config.
+func WithTracer(t Tracer) PoolOption {
+	return func(cfg *pgxpool.Config) {
+		queryTracerOf(cfg).tracer = t
+	}
+}
+
+// queryTracerOf returns queryTracer of pool config, setting a new one if there is none.
+func queryTracerOf(cfg *pgxpool.Config) *queryTracer {
+	if t, ok := cfg.ConnConfig.Tracer.(*queryTracer); ok {
+		return t
+	}
+
+	t := &queryTracer{}
+	cfg.ConnConfig.Tracer = t
+
+	return t
+}
+
+type callSpanKey struct{}
+
+// callSpan accumulates queries made within a Traced call.
+type callSpan struct {
+	mu      sync.Mutex
+	tracer  *queryTracer
+	sql     string
+	queries int64
+	rows    int64
+}
+
+// Traced runs fn as a single operation called name. Queries fn makes with the context
+// it receives are reported by WithTracer as one span of the whole call,
+// with number of queries, total number of rows and duration of the call.
+// If the pool has no tracer, fn is just called.
+func Traced(ctx context.Context, name string, fn func(ctx context.Context) error) error {
+	cs := &callSpan{}
+	start := time.Now()
+	err := fn(context.WithValue(ctx, callSpanKey{}, cs))
+
+	// Tracer is only known if some query was made.
+	if cs.tracer != nil {
+		cs.tracer.report(ctx, Span{
+			Operation: name,
+			SQL:       cs.sql,
+			Queries:   cs.queries,
+			Rows:      cs.rows,
+			Duration:  time.Since(start),
+			Err:       err,
+		})
+	}
+
+	return err
+}
+
+// TraceGetUsers wraps f (e.g. GetUsers4), so that its calls are traced as operation name (see Traced).
+func TraceGetUsers(name string, f func(context.Context, pgx.Tx, []int) ([]string, error)) func(context.Context, pgx.Tx, []int) ([]string, error) {
+	return func(ctx context.Context, tx pgx.Tx, ids []int) (names []string, err error) {
+		err = Traced(ctx, name, func(ctx context.Context) error {
+			names, err = f(ctx, tx, ids)
+			return err
+		})
+
+		return names, err
+	}
+}
+
+// TraceInsertUsers wraps f (e.g. InsertUsers6), so that its calls are traced as operation name (see Traced).
+func TraceInsertUsers(name string, f func(context.Context, pgx.Tx, []int) error) func(context.Context, pgx.Tx, []int) error {
+	return func(ctx context.Context, tx pgx.Tx, ids []int) error {
+		return Traced(ctx, name, func(ctx context.Context) error {
+			return f(ctx, tx, ids)
+		})
+	}
+}
+
+// queryTracer adapts Tracer and Collector to pgx tracer interfaces.
+type queryTracer struct {
+	tracer    Tracer
+	collector Collector
+}
+
+type spanStartKey struct{}
+
+type spanStart struct {
+	sql   string
+	start time.Time
+}
+
+func (t *queryTracer) start(ctx context.Context, sql string) context.Context {
+	return context.WithValue(ctx, spanStartKey{}, spanStart{sql: sql, start: time.Now()})
+}
+
+func (t *queryTracer) end(ctx context.Context, rows int64, err error) {
+	s, _ := ctx.Value(spanStartKey{}).(spanStart)
+
+	if t.collector != nil {
+		t.collector.Observe(callerName(), int(rows), time.Since(s.start))
+	}
+
+	if t.tracer == nil {
+		return
+	}
+
+	if cs, ok := ctx.Value(callSpanKey{}).(*callSpan); ok {
+		cs.mu.Lock()
+		defer cs.mu.Unlock()
+
+		cs.tracer = t
+		if cs.queries == 0 {
+			cs.sql = s.sql
+		}
+		cs.queries++
+		cs.rows += rows
+
+		return
+	}
+
+	t.report(ctx, Span{
+		SQL:      s.sql,
+		Queries:  1,
+		Rows:     rows,
+		Duration: time.Since(s.start),
+		Err:      err,
+	})
+}
+
+func (t *queryTracer) report(ctx context.Context, span Span) {
+	if t.tracer != nil {
+		t.tracer.TraceQuery(ctx, span)
+	}
+}
+
+func (t *queryTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	return t.start(ctx, data.SQL)
+}
+
+func (t *queryTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	t.end(ctx, data.CommandTag.RowsAffected(), data.Err)
+}
+
+func (t *queryTracer) TraceBatchStart(ctx context.Context, _ *pgx.Conn, _ pgx.TraceBatchStartData) context.Context {
+	return t.start(ctx, "batch")
+}
+
+// TraceBatchQuery reports every query of the batch. Their durations are measured
+// from the batch start, because queries are sent to the server together.
+func (t *queryTracer) TraceBatchQuery(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchQueryData) {
+	s, _ := ctx.Value(spanStartKey{}).(spanStart)
+	s.sql = data.SQL
+	t.end(context.WithValue(ctx, spanStartKey{}, s), data.CommandTag.RowsAffected(), data.Err)
+}
+
+func (t *queryTracer) TraceBatchEnd(context.Context, *pgx.Conn, pgx.TraceBatchEndData) {}
+
+func (t *queryTracer) TraceCopyFromStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromStartData) context.Context {
+	sql := fmt.Sprintf("copy %s(%s) from stdin", data.TableName.Sanitize(), strings.Join(data.ColumnNames, ","))
+	return t.start(ctx, sql)
+}
+
+func (t *queryTracer) TraceCopyFromEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceCopyFromEndData) {
+	t.end(ctx, data.CommandTag.RowsAffected(), data.Err)
+}
@@ -0,0 +1,80 @@
+package pgperf_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"pgperf"
+)
+
+// recordingTracer keeps all spans it receives.
+type recordingTracer struct {
+	mu    sync.Mutex
+	spans []pgperf.Span
+}
+
+func (r *recordingTracer) TraceQuery(_ context.Context, span pgperf.Span) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.spans = append(r.spans, span)
+}
+
+func TestWithTracer(t *testing.T) {
+	requireDB(t)
+
+	tracer := &recordingTracer{}
+	p, err := pgperf.NewTunedPool(ctx, connString, pgperf.WithTracer(tracer))
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer p.Close()
+
+	tx, err := p.Begin(ctx)
+	if err != nil {
+		t.Fatalf("failed to start transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	ids := []int{1, 2, 3}
+	if _, err := pgperf.TraceGetUsers("GetUsers1", pgperf.GetUsers1)(ctx, tx, ids); err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	if err := pgperf.TraceInsertUsers("InsertUsers6", pgperf.InsertUsers6)(ctx, tx, []int{3800001, 3800002}); err != nil {
+		t.Fatalf("failed to insert users: %v", err)
+	}
+
+	// Untraced query is reported on its own.
+	if _, err := pgperf.GetUsers4(ctx, tx, ids); err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+
+	spans := map[string]pgperf.Span{}
+	for _, s := range tracer.spans {
+		if s.Err != nil || s.SQL == "" || s.Duration <= 0 {
+			t.Fatalf("unexpected span %+v", s)
+		}
+
+		if _, ok := spans[s.Operation]; ok && s.Operation != "" {
+			t.Fatalf("operation %q reported more than once", s.Operation)
+		}
+		spans[s.Operation] = s
+	}
+
+	if s := spans["GetUsers1"]; s.Queries != int64(len(ids)) || s.Rows != int64(len(ids)) {
+		t.Fatalf("unexpected GetUsers1 span %+v", s)
+	}
+
+	if s := spans["InsertUsers6"]; s.Queries != 1 || s.Rows != 2 {
+		t.Fatalf("unexpected InsertUsers6 span %+v", s)
+	}
+
+	if s := spans[""]; s.Queries != 1 || s.Rows != int64(len(ids)) {
+		t.Fatalf("unexpected GetUsers4 span %+v", s)
+	}
+}
@@ -0,0 +1,628 @@
+package pgperf
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/shopspring/decimal"
+)
+
+// TotalBalance returns sum of all account balances in given currency.
+// Returns zero if there are no accounts in this currency.
+func TotalBalance(ctx context.Context, tx pgx.Tx, currency string) (decimal.Decimal, error) {
+	var total decimal.Decimal
+	q := "select coalesce(sum(amount), 0) from test.accounts where currency = $1"
+	if err := tx.QueryRow(ctx, q, currency).Scan(&total); err != nil {
+		return decimal.Zero, fmt.Errorf("failed to get total %s balance: %w", currency, err)
+	}
+
+	return total, nil
+}
+
+// AssertConserved checks that fn does not change total balance of currency.
+// Totals are read on conn before and after calling fn, so fn should use other connections
+// (or commit its own transactions on conn) for changes to be visible.
+func AssertConserved(ctx context.Context, conn *pgxpool.Conn, currency string, fn func() error) error {
+	before, err := totalBalanceConn(ctx, conn, currency)
+	if err != nil {
+		return err
+	}
+
+	if err := fn(); err != nil {
+		return err
+	}
+
+	after, err := totalBalanceConn(ctx, conn, currency)
+	if err != nil {
+		return err
+	}
+
+	if !before.Equal(after) {
+		return fmt.Errorf("total %s amount changed (before/after) %v/%v", currency, before, after)
+	}
+
+	return nil
+}
+
+// totalBalanceConn reads total balance in a separate short transaction.
+func totalBalanceConn(ctx context.Context, conn *pgxpool.Conn, currency string) (decimal.Decimal, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return decimal.Zero, fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	return TotalBalance(ctx, tx, currency)
+}
+
+// BulkCredit adds amounts to account balances in one statement and returns ids of accounts
+// that were actually updated. Callers can diff them against the requested ids to find
+// accounts that do not exist.
+func BulkCredit(ctx context.Context, tx pgx.Tx, credits map[int]decimal.Decimal) ([]int, error) {
+	ids := make([]int, 0, len(credits))
+	amounts := make([]decimal.Decimal, 0, len(credits))
+	for id, amt := range credits {
+		ids = append(ids, id)
+		amounts = append(amounts, amt)
+	}
+
+	q := `update test.accounts a
+	         set amount = a.amount + c.amount
+	        from unnest($1::bigint[], $2::numeric[]) c(id, amount)
+	       where a.id = c.id
+	   returning a.id`
+
+	rows, err := tx.Query(ctx, q, ids, amounts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to credit accounts: %w", err)
+	}
+	defer rows.Close()
+
+	updated := make([]int, 0, len(credits))
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan account id: %w", err)
+		}
+
+		updated = append(updated, id)
+	}
+
+	return updated, rows.Err()
+}
+
+// ResetBalances sets balance of every account in currency to amount in one statement,
+// so tests can start from a known state.
+func ResetBalances(ctx context.Context, conn *pgxpool.Conn, amount decimal.Decimal, currency string) error {
+	if _, err := conn.Exec(ctx, "update test.accounts set amount = $1 where currency = $2", amount, currency); err != nil {
+		return fmt.Errorf("failed to reset %s balances: %w", currency, err)
+	}
+
+	return nil
+}
+
+// Account is a row of test.accounts table.
+type Account struct {
+	ID       int
+	UserID   int
+	Currency string
+	Amount   decimal.Decimal
+}
+
+// InsertAccounts inserts accounts (their ids are assigned by the database) in one statement
+// run in query exec mode. Amounts are numeric, and with QueryExecModeSimpleProtocol they are
+// sent as text, while with other modes they are encoded in numeric binary format.
+func InsertAccounts(ctx context.Context, tx pgx.Tx, accts []Account, mode pgx.QueryExecMode) error {
+	userIDs := make([]int, len(accts))
+	currencies := make([]string, len(accts))
+	amounts := make([]decimal.Decimal, len(accts))
+	for i, a := range accts {
+		userIDs[i], currencies[i], amounts[i] = a.UserID, a.Currency, a.Amount
+	}
+
+	q := `insert into test.accounts(user_id, currency, amount)
+	      select * from unnest($1::bigint[], $2::varchar[], $3::numeric[])`
+
+	if _, err := tx.Exec(ctx, q, mode, userIDs, currencies, amounts); err != nil {
+		return MapError(fmt.Errorf("failed to insert accounts: %w", err))
+	}
+
+	return nil
+}
+
+// Transfer is a transfer of Amount from one account to another.
+type Transfer struct {
+	From   int
+	To     int
+	Amount decimal.Decimal
+}
+
+// TransferWithSavepoint applies transfers in one transaction, wrapping each of them
+// in a savepoint (pgx starts one when Begin is called on a transaction), so a failed
+// transfer is rolled back alone instead of aborting the whole transaction.
+// Returns per-transfer errors and a fatal error if transaction itself can't continue.
+func TransferWithSavepoint(ctx context.Context, tx pgx.Tx, transfers []Transfer) ([]error, error) {
+	errs := make([]error, len(transfers))
+	for i, t := range transfers {
+		sp, err := tx.Begin(ctx)
+		if err != nil {
+			return errs, fmt.Errorf("failed to create savepoint: %w", err)
+		}
+
+		if _, err := TransferLock(ctx, sp, t.From, t.To, t.Amount); err != nil {
+			if tx.Conn().IsClosed() {
+				return errs, err
+			}
+
+			errs[i] = err
+			if err := sp.Rollback(ctx); err != nil {
+				return errs, fmt.Errorf("failed to rollback to savepoint: %w", err)
+			}
+
+			continue
+		}
+
+		if err := sp.Commit(ctx); err != nil {
+			return errs, fmt.Errorf("failed to release savepoint: %w", err)
+		}
+	}
+
+	return errs, nil
+}
+
+// JournalEntry is a record of transfer intent written by TransferJournaled.
+type JournalEntry struct {
+	Time   time.Time       `json:"time"`
+	From   int             `json:"from"`
+	To     int             `json:"to"`
+	Amount decimal.Decimal `json:"amount"`
+}
+
+// TransferJournaled writes transfer intent to journal as a JSON line and only then executes
+// the transfer, so there is a record of it even if the process crashes before commit.
+// The entry is written even if the transfer then fails, journal readers have to reconcile
+// intents with the database.
+func TransferJournaled(ctx context.Context, tx pgx.Tx, journal io.Writer, from, to int, amt decimal.Decimal) error {
+	entry := JournalEntry{Time: time.Now().UTC(), From: from, To: to, Amount: amt}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to marshal journal entry: %w", err)
+	}
+
+	if _, err := journal.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write journal entry: %w", err)
+	}
+
+	_, err = TransferLock(ctx, tx, from, to, amt)
+
+	return err
+}
+
+// CreditIfNotCredited credits accounts that were not credited on runDate (or later) yet,
+// and marks them as credited. Re-running the job for the same date is a no-op,
+// because condition on last_credited filters out already credited accounts.
+// Only the calendar date of runDate (in its own location) is used, session TimeZone does not matter.
+// Returns number of accounts actually credited.
+func CreditIfNotCredited(ctx context.Context, tx pgx.Tx, credits map[int]decimal.Decimal, runDate time.Time) (int64, error) {
+	ids := make([]int, 0, len(credits))
+	amounts := make([]decimal.Decimal, 0, len(credits))
+	for id, amt := range credits {
+		ids = append(ids, id)
+		amounts = append(amounts, amt)
+	}
+
+	q := `update test.accounts a
+	         set amount = a.amount + c.amount,
+	             last_credited = $3
+	        from unnest($1::bigint[], $2::numeric[]) c(id, amount)
+	       where a.id = c.id
+	         and (a.last_credited is null or a.last_credited < $3)`
+
+	// Bound as date, not as timestamptz: converting timestamptz to date depends on TimeZone.
+	r, err := tx.Exec(ctx, q, ids, amounts, pgtype.Date{Time: runDate, Valid: true})
+	if err != nil {
+		return 0, fmt.Errorf("failed to credit accounts: %w", err)
+	}
+
+	return r.RowsAffected(), nil
+}
+
+// ErrDuplicateTransfer is returned by TransferIdempotent when transfer with the same key was already made.
+var ErrDuplicateTransfer = errors.New("duplicate transfer")
+
+// TransferIdempotent makes transfer only once per key, so it can be safely retried.
+// Key is recorded in test.transfer_log in the same transaction as balance updates,
+// so either both are committed or none. Returns ErrDuplicateTransfer if key is already there.
+func TransferIdempotent(ctx context.Context, tx pgx.Tx, key string, from, to int, amt decimal.Decimal) error {
+	q := `insert into test.transfer_log(key, from_id, to_id, amount)
+	      values ($1, $2, $3, $4)
+	      on conflict (key) do nothing`
+
+	r, err := tx.Exec(ctx, q, key, from, to, amt)
+	if err != nil {
+		return MapError(fmt.Errorf("failed to log transfer: %w", err))
+	}
+
+	if r.RowsAffected() == 0 {
+		return fmt.Errorf("%w: key %q", ErrDuplicateTransfer, key)
+	}
+
+	_, err = TransferLock(ctx, tx, from, to, amt)
+
+	return err
+}
+
+// RecentTransferCount returns number of logged transfers from or to account within window
+// (counting back from the transaction start time).
+func RecentTransferCount(ctx context.Context, tx pgx.Tx, accountID int, window time.Duration) (int, error) {
+	return recentTransferCount(ctx, tx, "(from_id = $1 or to_id = $1)", accountID, window)
+}
+
+// recentTransferCount counts logged transfers within window matching cond on account $1.
+func recentTransferCount(ctx context.Context, tx pgx.Tx, cond string, accountID int, window time.Duration) (int, error) {
+	q := `select count(*)
+	        from test.transfer_log
+	       where ` + cond + `
+	         and created_at > now() - make_interval(secs => $2)`
+
+	var n int
+	if err := tx.QueryRow(ctx, q, accountID, window.Seconds()).Scan(&n); err != nil {
+		return 0, fmt.Errorf("failed to count recent transfers: %w", err)
+	}
+
+	return n, nil
+}
+
+// ErrVelocityExceeded is returned by VelocityGuard when account made too many transfers recently.
+var ErrVelocityExceeded = errors.New("transfer velocity exceeded")
+
+// VelocityGuard limits number of transfers an account can make within a time window.
+type VelocityGuard struct {
+	Window time.Duration
+	Limit  int
+}
+
+// Transfer makes transfer with TransferLock unless source account already made Limit
+// transfers within Window (transfers to the account do not count), and logs it
+// to test.transfer_log to be counted later.
+// Note that concurrent transfers from the same account may both pass the check
+// (count is not locked), so the limit is approximate under concurrency.
+func (g VelocityGuard) Transfer(ctx context.Context, tx pgx.Tx, from, to int, amt decimal.Decimal) error {
+	n, err := recentTransferCount(ctx, tx, "from_id = $1", from, g.Window)
+	if err != nil {
+		return err
+	}
+
+	if n >= g.Limit {
+		return fmt.Errorf("%w: account %d made %d transfers in %v", ErrVelocityExceeded, from, n, g.Window)
+	}
+
+	if _, err := TransferLock(ctx, tx, from, to, amt); err != nil {
+		return err
+	}
+
+	q := "insert into test.transfer_log(from_id, to_id, amount) values ($1, $2, $3)"
+	if _, err := tx.Exec(ctx, q, from, to, amt); err != nil {
+		return fmt.Errorf("failed to log transfer: %w", err)
+	}
+
+	return nil
+}
+
+// ErrInsufficientFunds is returned when a transfer would make account balance negative.
+// Unlike serialization failures and deadlocks it is deterministic, so retrying does not help.
+var ErrInsufficientFunds = errors.New("insufficient funds")
+
+// SettleBatch applies transfers atomically in a single statement: net deltas are aggregated
+// per account and applied with one update, which is much faster than calling TransferLock
+// in a loop. Accounts are locked in id order to avoid deadlocks between concurrent batches.
+// Amounts are validated like TransferLock does. If any amount is invalid, balance would become
+// negative, an account does not exist or a transfer is between accounts with different
+// currencies, the whole batch is rolled back (to a savepoint, so tx can still be used).
+func SettleBatch(ctx context.Context, tx pgx.Tx, transfers []Transfer) error {
+	from := make([]int, len(transfers))
+	to := make([]int, len(transfers))
+	amounts := make([]decimal.Decimal, len(transfers))
+	accounts := make(map[int]struct{}, len(transfers)*2)
+	for i, t := range transfers {
+		if t.From == t.To {
+			return fmt.Errorf("transfer %d: can't transfer to the same account %d", i, t.From)
+		}
+
+		if err := ValidateAmount(t.Amount, maxCurrencyScale); err != nil {
+			return fmt.Errorf("transfer %d: %w", i, err)
+		}
+
+		from[i], to[i], amounts[i] = t.From, t.To, t.Amount
+		accounts[t.From] = struct{}{}
+		accounts[t.To] = struct{}{}
+	}
+
+	q := `with transfers as (
+	          select * from unnest($1::bigint[], $2::bigint[], $3::numeric[])
+	                   with ordinality t(from_id, to_id, amount, ord)
+	      ), deltas as (
+	          select id, sum(delta) as delta
+	            from (select from_id as id, -amount as delta from transfers
+	                  union all
+	                  select to_id, amount from transfers) d
+	           group by id
+	      ), locked as materialized (
+	          select id from test.accounts
+	           where id in (select id from deltas)
+	           order by id
+	             for update
+	      ), updated as (
+	          update test.accounts a
+	             set amount = a.amount + d.delta
+	            from locked l
+	            join deltas d on d.id = l.id
+	           where a.id = l.id
+	       returning a.id, a.amount
+	      ), pairs as (
+	          select array_agg(f.currency order by t.ord) as from_currency,
+	                 array_agg(d.currency order by t.ord) as to_currency
+	            from transfers t
+	            join test.accounts f on f.id = t.from_id
+	            join test.accounts d on d.id = t.to_id
+	      )
+	      select (select coalesce(array_agg(id), '{}') from updated),
+	             (select count(*) from updated where amount < 0),
+	             p.from_currency,
+	             p.to_currency
+	        from pairs p`
+
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to create savepoint: %w", err)
+	}
+	defer sp.Rollback(ctx)
+
+	var (
+		updated                  []int
+		nNegative                int
+		fromCurrency, toCurrency []string
+	)
+	if err := sp.QueryRow(ctx, q, from, to, amounts).Scan(&updated, &nNegative, &fromCurrency, &toCurrency); err != nil {
+		return mapAmountError(fmt.Errorf("failed to settle transfers: %w", err))
+	}
+
+	// Only accounts that do not exist are not updated
+	// (and transfers involving them are missing from currency pairs).
+	if len(updated) != len(accounts) {
+		for _, id := range updated {
+			delete(accounts, id)
+		}
+
+		missing := make([]int, 0, len(accounts))
+		for id := range accounts {
+			missing = append(missing, id)
+		}
+		sort.Ints(missing)
+
+		return fmt.Errorf("accounts %v do not exist: %w", missing, sql.ErrNoRows)
+	}
+
+	for i, t := range transfers {
+		if fromCurrency[i] != toCurrency[i] {
+			return fmt.Errorf("transfer %d: can't transfer between different currencies", i)
+		}
+
+		if err := ValidateAmountScale(t.Amount, fromCurrency[i]); err != nil {
+			return fmt.Errorf("transfer %d: %w", i, err)
+		}
+	}
+
+	if nNegative > 0 {
+		return fmt.Errorf("%w on %d accounts", ErrInsufficientFunds, nNegative)
+	}
+
+	if err := sp.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to release savepoint: %w", err)
+	}
+
+	return nil
+}
+
+// SettleBatchWithRetry settles transfers with SettleBatch in a transaction of its own, retrying
+// the whole batch (at most maxRetries times) on serialization failure or deadlock (see RunWithRetry).
+// ErrInsufficientFunds and other errors are returned without retries.
+func SettleBatchWithRetry(ctx context.Context, pool *pgxpool.Pool, transfers []Transfer, maxRetries int) error {
+	return RunWithRetry(ctx, pool, func(tx pgx.Tx) error {
+		return SettleBatch(ctx, tx, transfers)
+	}, maxRetries)
+}
+
+// BalanceRow is a change of account balance caused by a logged transfer.
+type BalanceRow struct {
+	Time  time.Time
+	Delta decimal.Decimal
+	// Balance is a running sum of deltas up to and including this row.
+	Balance decimal.Decimal
+}
+
+// GetBalanceHistory returns changes of account balance recorded in test.transfer_log
+// in chronological order, with running balance computed by a window function.
+// Running balance starts from zero, so it is relative to the balance before the first logged transfer.
+func GetBalanceHistory(ctx context.Context, tx pgx.Tx, accountID int) ([]BalanceRow, error) {
+	q := `select created_at, delta, sum(delta) over (order by created_at, id)
+	        from (select id, created_at,
+	                     case when to_id = $1 then amount else -amount end as delta
+	                from test.transfer_log
+	               where from_id = $1 or to_id = $1) t
+	       order by created_at, id`
+
+	rows, err := tx.Query(ctx, q, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balance history: %w", err)
+	}
+	defer rows.Close()
+
+	var history []BalanceRow
+	for rows.Next() {
+		var r BalanceRow
+		if err := rows.Scan(&r.Time, &r.Delta, &r.Balance); err != nil {
+			return nil, fmt.Errorf("failed to scan balance row: %w", err)
+		}
+
+		history = append(history, r)
+	}
+
+	return history, rows.Err()
+}
+
+// LockAccounts locks accounts with `for update` and returns their current balances.
+// Rows are locked in id order, so callers locking overlapping sets of accounts
+// can wait for each other, but can't deadlock. Accounts that do not exist are not in the result.
+func LockAccounts(ctx context.Context, tx pgx.Tx, ids []int) (map[int]decimal.Decimal, error) {
+	q := "select id, amount from test.accounts where id = any($1) order by id for update"
+	rows, err := tx.Query(ctx, q, ids)
+	if err != nil {
+		return nil, MapError(fmt.Errorf("failed to lock accounts: %w", err))
+	}
+	defer rows.Close()
+
+	res := make(map[int]decimal.Decimal, len(ids))
+	for rows.Next() {
+		var (
+			id     int
+			amount decimal.Decimal
+		)
+		if err := rows.Scan(&id, &amount); err != nil {
+			return nil, fmt.Errorf("failed to scan account balance: %w", err)
+		}
+
+		res[id] = amount
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, MapError(fmt.Errorf("failed to lock accounts: %w", err))
+	}
+
+	return res, nil
+}
+
+// transferRetries is how many times RunTransfers retries a transfer failed with a serialization error or deadlock.
+const transferRetries = 3
+
+// RunTransfers makes transfers with TransferLock, each in its own transaction (see RunWithRetry),
+// by at most concurrency transfers at the same time (GOMAXPROCS if concurrency <= 0).
+// Returns error of each transfer at its index.
+func RunTransfers(ctx context.Context, pool *pgxpool.Pool, transfers []Transfer, concurrency int) []error {
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+
+	var (
+		errs = make([]error, len(transfers))
+		sem  = make(chan struct{}, concurrency)
+		wg   sync.WaitGroup
+	)
+	for i, t := range transfers {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, t Transfer) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			errs[i] = RunWithRetry(ctx, pool, func(tx pgx.Tx) error {
+				_, err := TransferLock(ctx, tx, t.From, t.To, t.Amount)
+				return err
+			}, transferRetries)
+		}(i, t)
+	}
+
+	wg.Wait()
+
+	return errs
+}
+
+// GetBalanceForShare reads account balance locking it with `for share` until tx ends,
+// e.g. to validate the balance and then act on it. Writers (transfers) wait until the lock
+// is released, so the balance can't change in between, but unlike `for update`
+// other `for share` readers are not blocked.
+func GetBalanceForShare(ctx context.Context, tx pgx.Tx, id int) (decimal.Decimal, error) {
+	var amount decimal.Decimal
+	if err := tx.QueryRow(ctx, "select amount from test.accounts where id = $1 for share", id).Scan(&amount); err != nil {
+		return decimal.Zero, MapError(fmt.Errorf("failed to get balance of account %d: %w", id, err))
+	}
+
+	return amount, nil
+}
+
+// RichAccountsQuery is the query of GetRichAccounts, e.g. to look at its plan with Explain.
+const RichAccountsQuery = "select coalesce(array_agg(id), '{}') from test.accounts where currency = $1 and amount > $2"
+
+// GetRichAccounts returns ids of accounts in currency with balance above minAmount.
+// array_agg returns NULL when there are no such accounts, which is returned as an empty slice.
+func GetRichAccounts(ctx context.Context, tx pgx.Tx, currency string, minAmount decimal.Decimal) ([]int, error) {
+	ids := []int{}
+	if err := tx.QueryRow(ctx, RichAccountsQuery, currency, minAmount).Scan(&ids); err != nil {
+		return nil, MapError(fmt.Errorf("failed to get %s accounts: %w", currency, err))
+	}
+
+	return ids, nil
+}
+
+// LockAccountsTimeout is LockAccounts that gives up with ErrLockTimeout if the accounts
+// can't be locked within d, instead of waiting for concurrent transactions indefinitely.
+// lock_timeout is set only for this statement, and it runs in a savepoint,
+// so after a timeout tx can still be used (e.g. to retry).
+// d must be positive (zero lock_timeout means waiting forever), it is rounded up to milliseconds.
+func LockAccountsTimeout(ctx context.Context, tx pgx.Tx, ids []int, d time.Duration) (map[int]decimal.Decimal, error) {
+	if d <= 0 {
+		return nil, fmt.Errorf("invalid lock timeout %v", d)
+	}
+
+	sp, err := tx.Begin(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create savepoint: %w", err)
+	}
+	defer sp.Rollback(ctx)
+
+	var prev string
+	if err := sp.QueryRow(ctx, "select current_setting('lock_timeout')").Scan(&prev); err != nil {
+		return nil, fmt.Errorf("failed to get lock timeout: %w", err)
+	}
+
+	if err := setLockTimeout(ctx, sp, timeoutMillis(d)); err != nil {
+		return nil, err
+	}
+
+	locked, err := LockAccounts(ctx, sp, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setLockTimeout(ctx, sp, prev); err != nil {
+		return nil, err
+	}
+
+	if err := sp.Commit(ctx); err != nil {
+		return nil, fmt.Errorf("failed to release savepoint: %w", err)
+	}
+
+	return locked, nil
+}
+
+// setLockTimeout sets lock_timeout until the end of tx (as `set local` does).
+func setLockTimeout(ctx context.Context, tx pgx.Tx, timeout string) error {
+	if _, err := tx.Exec(ctx, "select set_config('lock_timeout', $1, true)", timeout); err != nil {
+		return fmt.Errorf("failed to set lock timeout: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,1015 @@
+package pgperf_test
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"pgperf"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/shopspring/decimal"
+)
+
+// balances returns current balances of accounts.
+func balances(t *testing.T, tx pgx.Tx, ids []int) map[int]decimal.Decimal {
+	t.Helper()
+
+	rows, err := tx.Query(ctx, "select id, amount from test.accounts where id = any($1)", ids)
+	if err != nil {
+		t.Fatalf("failed to get balances: %v", err)
+	}
+	defer rows.Close()
+
+	res := make(map[int]decimal.Decimal, len(ids))
+	for rows.Next() {
+		var (
+			id     int
+			amount decimal.Decimal
+		)
+		if err := rows.Scan(&id, &amount); err != nil {
+			t.Fatalf("failed to scan balance: %v", err)
+		}
+
+		res[id] = amount
+	}
+
+	if err := rows.Err(); err != nil {
+		t.Fatalf("failed to get balances: %v", err)
+	}
+
+	return res
+}
+
+func TestTotalBalanceEmptyCurrency(t *testing.T) {
+	tx := testTx(t)
+
+	total, err := pgperf.TotalBalance(ctx, tx, "")
+	if err != nil {
+		t.Fatalf("failed to get total balance: %v", err)
+	}
+
+	if !total.IsZero() {
+		t.Fatalf("expected zero total, got %v", total)
+	}
+}
+
+func TestAssertConserved(t *testing.T) {
+	requireDB(t)
+
+	conn, err := getConn(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	ids := idrtAccounts(t, conn, 2)
+
+	err = pgperf.AssertConserved(ctx, conn, "IDRT", func() error {
+		other, err := getConn(ctx)
+		if err != nil {
+			return err
+		}
+		defer other.Release()
+
+		doTrx(ctx, other, pgperf.TransferLock, ids[0], ids[1], 10)
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("expected transfer to conserve balance: %v", err)
+	}
+
+	err = pgperf.AssertConserved(ctx, conn, "IDRT", func() error {
+		_, err := pool.Exec(ctx, "update test.accounts set amount = amount + 1 where id = $1", ids[0])
+		return err
+	})
+	t.Cleanup(func() {
+		pool.Exec(ctx, "update test.accounts set amount = amount - 1 where id = $1", ids[0])
+	})
+	if err == nil {
+		t.Fatal("expected error for non-conserving change")
+	}
+}
+
+func TestBulkCreditReturnsUpdatedIDs(t *testing.T) {
+	tx := testTx(t)
+
+	existing := idrtAccounts(t, tx, 2)
+
+	credits := map[int]decimal.Decimal{
+		existing[0]: decimal.NewFromInt(1),
+		existing[1]: decimal.NewFromInt(2),
+		-1:          decimal.NewFromInt(3),
+		-2:          decimal.NewFromInt(4),
+	}
+
+	updated, err := pgperf.BulkCredit(ctx, tx, credits)
+	if err != nil {
+		t.Fatalf("failed to credit accounts: %v", err)
+	}
+
+	sort.Ints(updated)
+	sort.Ints(existing)
+	if len(updated) != len(existing) || updated[0] != existing[0] || updated[1] != existing[1] {
+		t.Fatalf("expected updated ids %v, got %v", existing, updated)
+	}
+}
+
+func TestResetBalances(t *testing.T) {
+	requireDB(t)
+
+	conn, err := getConn(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	// Use a separate currency not to break balances used by benchmarks.
+	const currency = "TST"
+	q := `insert into test.accounts (user_id, currency, amount)
+	      select g, $1, g * 10 from generate_series(1, 10) g`
+	if _, err := conn.Exec(ctx, q, currency); err != nil {
+		t.Fatalf("failed to create accounts: %v", err)
+	}
+	t.Cleanup(func() {
+		pool.Exec(ctx, "delete from test.accounts where currency = $1", currency)
+	})
+
+	amount := decimal.RequireFromString("100.5")
+	if err := pgperf.ResetBalances(ctx, conn, amount, currency); err != nil {
+		t.Fatalf("failed to reset balances: %v", err)
+	}
+
+	var amounts []decimal.Decimal
+	if err := conn.QueryRow(ctx, "select array_agg(amount) from test.accounts where currency = $1", currency).Scan(&amounts); err != nil {
+		t.Fatalf("failed to get balances: %v", err)
+	}
+
+	for _, a := range amounts {
+		if !a.Equal(amount) {
+			t.Fatalf("expected balance %v, got %v", amount, a)
+		}
+	}
+
+	total, err := pgperf.TotalBalance(ctx, testTx(t), currency)
+	if err != nil {
+		t.Fatalf("failed to get total balance: %v", err)
+	}
+
+	if expected := amount.Mul(decimal.NewFromInt(int64(len(amounts)))); !total.Equal(expected) {
+		t.Fatalf("expected total %v, got %v", expected, total)
+	}
+}
+
+func TestTransferWithSavepoint(t *testing.T) {
+	tx := testTx(t)
+
+	ids := idrtAccounts(t, tx, 2)
+
+	before := balances(t, tx, ids)
+
+	transfers := []pgperf.Transfer{
+		{From: ids[0], To: ids[1], Amount: decimal.NewFromInt(10)},
+		{From: ids[0], To: ids[1], Amount: decimal.NewFromInt(1000000000000)},
+		{From: ids[1], To: ids[0], Amount: decimal.NewFromInt(3)},
+	}
+
+	errs, err := pgperf.TransferWithSavepoint(ctx, tx, transfers)
+	if err != nil {
+		t.Fatalf("transfers failed: %v", err)
+	}
+
+	if errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Fatalf("expected only second transfer to fail, got %v", errs)
+	}
+
+	after := balances(t, tx, ids)
+
+	if !after[ids[0]].Equal(before[ids[0]].Sub(decimal.NewFromInt(7))) {
+		t.Fatalf("unexpected balance %v -> %v", before[ids[0]], after[ids[0]])
+	}
+}
+
+func TestTransferLockOppositeDirections(t *testing.T) {
+	requireDB(t)
+
+	ids := idrtAccounts(t, pool, 2)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 200)
+	for i := 0; i < 2; i++ {
+		from, to := ids[i], ids[1-i]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 100; j++ {
+				tx, err := pool.Begin(ctx)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				_, err = pgperf.TransferLock(ctx, tx, from, to, decimal.NewFromInt(1))
+				if err == nil {
+					err = tx.Commit(ctx)
+				}
+				tx.Rollback(ctx)
+
+				if err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if errors.Is(err, pgperf.ErrDeadlock) {
+			t.Fatalf("deadlock detected: %v", err)
+		}
+	}
+}
+
+func TestTransferJournaled(t *testing.T) {
+	tx := testTx(t)
+
+	ids := idrtAccounts(t, tx, 2)
+
+	var journal bytes.Buffer
+	if err := pgperf.TransferJournaled(ctx, tx, &journal, ids[0], ids[1], decimal.NewFromInt(10)); err != nil {
+		t.Fatalf("transfer failed: %v", err)
+	}
+
+	huge := decimal.NewFromInt(1000000000000)
+	if err := pgperf.TransferJournaled(ctx, tx, &journal, ids[0], ids[1], huge); err == nil {
+		t.Fatal("expected transfer to fail")
+	}
+
+	var entries []pgperf.JournalEntry
+	dec := json.NewDecoder(&journal)
+	for dec.More() {
+		var e pgperf.JournalEntry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatalf("failed to decode journal entry: %v", err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 journal entries, got %d", len(entries))
+	}
+
+	if entries[0].From != ids[0] || entries[0].To != ids[1] || !entries[0].Amount.Equal(decimal.NewFromInt(10)) {
+		t.Fatalf("unexpected journal entry %+v", entries[0])
+	}
+
+	if !entries[1].Amount.Equal(huge) {
+		t.Fatalf("failed transfer is not journaled: %+v", entries[1])
+	}
+}
+
+func TestCreditIfNotCredited(t *testing.T) {
+	tx := testTx(t)
+
+	ids := idrtAccounts(t, tx, 3)
+
+	credits := make(map[int]decimal.Decimal, len(ids))
+	for _, id := range ids {
+		credits[id] = decimal.RequireFromString("0.01")
+	}
+
+	// Midnight UTC is still the previous day in this time zone.
+	if _, err := tx.Exec(ctx, "set local timezone = 'Pacific/Pago_Pago'"); err != nil {
+		t.Fatalf("failed to set time zone: %v", err)
+	}
+
+	// Use a date far in the future, so previous runs do not interfere.
+	runDate := time.Date(2999, 1, 1, 0, 0, 0, 0, time.UTC)
+	n, err := pgperf.CreditIfNotCredited(ctx, tx, credits, runDate)
+	if err != nil {
+		t.Fatalf("failed to credit accounts: %v", err)
+	}
+
+	if n != int64(len(ids)) {
+		t.Fatalf("expected %d credited accounts, got %d", len(ids), n)
+	}
+
+	var lastCredited string
+	if err := tx.QueryRow(ctx, "select last_credited::text from test.accounts where id = $1", ids[0]).Scan(&lastCredited); err != nil {
+		t.Fatalf("failed to get last credited date: %v", err)
+	}
+
+	if lastCredited != "2999-01-01" {
+		t.Fatalf("expected account to be credited on 2999-01-01, got %s", lastCredited)
+	}
+
+	n, err = pgperf.CreditIfNotCredited(ctx, tx, credits, runDate)
+	if err != nil {
+		t.Fatalf("failed to credit accounts: %v", err)
+	}
+
+	if n != 0 {
+		t.Fatalf("expected second run to credit nothing, got %d", n)
+	}
+}
+
+func TestTransferIdempotent(t *testing.T) {
+	tx := testTx(t)
+
+	ids := idrtAccounts(t, tx, 2)
+
+	before := balances(t, tx, ids)
+
+	key := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	amt := decimal.NewFromInt(10)
+	if err := pgperf.TransferIdempotent(ctx, tx, key, ids[0], ids[1], amt); err != nil {
+		t.Fatalf("transfer failed: %v", err)
+	}
+
+	err := pgperf.TransferIdempotent(ctx, tx, key, ids[0], ids[1], amt)
+	if !errors.Is(err, pgperf.ErrDuplicateTransfer) {
+		t.Fatalf("expected duplicate transfer error, got %v", err)
+	}
+
+	after := balances(t, tx, ids)
+	if !after[ids[0]].Equal(before[ids[0]].Sub(amt)) || !after[ids[1]].Equal(before[ids[1]].Add(amt)) {
+		t.Fatalf("expected balance to move once: before %v, after %v", before, after)
+	}
+}
+
+func TestVelocityGuard(t *testing.T) {
+	tx := testTx(t)
+
+	ids := idrtAccounts(t, tx, 2)
+
+	const window = time.Minute
+	initial, err := pgperf.RecentTransferCount(ctx, tx, ids[0], window)
+	if err != nil {
+		t.Fatalf("failed to count transfers: %v", err)
+	}
+
+	var outgoing int
+	q := "select count(*) from test.transfer_log where from_id = $1 and created_at > now() - interval '1 minute'"
+	if err := tx.QueryRow(ctx, q, ids[0]).Scan(&outgoing); err != nil {
+		t.Fatalf("failed to count outgoing transfers: %v", err)
+	}
+
+	// Incoming transfers count as recent, but do not count against the limit.
+	unlimited := pgperf.VelocityGuard{Window: window, Limit: math.MaxInt32}
+	for i := 0; i < 3; i++ {
+		if err := unlimited.Transfer(ctx, tx, ids[1], ids[0], decimal.NewFromInt(1)); err != nil {
+			t.Fatalf("incoming transfer %d failed: %v", i, err)
+		}
+	}
+
+	guard := pgperf.VelocityGuard{Window: window, Limit: outgoing + 3}
+	for i := 0; i < 3; i++ {
+		if err := guard.Transfer(ctx, tx, ids[0], ids[1], decimal.NewFromInt(1)); err != nil {
+			t.Fatalf("transfer %d failed: %v", i, err)
+		}
+	}
+
+	n, err := pgperf.RecentTransferCount(ctx, tx, ids[0], window)
+	if err != nil {
+		t.Fatalf("failed to count transfers: %v", err)
+	}
+
+	if n != initial+6 {
+		t.Fatalf("expected %d recent transfers, got %d", initial+6, n)
+	}
+
+	err = guard.Transfer(ctx, tx, ids[0], ids[1], decimal.NewFromInt(1))
+	if !errors.Is(err, pgperf.ErrVelocityExceeded) {
+		t.Fatalf("expected velocity error, got %v", err)
+	}
+}
+
+func TestSettleBatch(t *testing.T) {
+	tx := testTx(t)
+
+	ids := idrtAccounts(t, tx, 3)
+
+	totalBefore, err := pgperf.TotalBalance(ctx, tx, "IDRT")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := balances(t, tx, ids)
+
+	transfers := []pgperf.Transfer{
+		{From: ids[0], To: ids[1], Amount: decimal.NewFromInt(10)},
+		{From: ids[1], To: ids[2], Amount: decimal.NewFromInt(4)},
+		{From: ids[2], To: ids[0], Amount: decimal.NewFromInt(1)},
+	}
+
+	if err := pgperf.SettleBatch(ctx, tx, transfers); err != nil {
+		t.Fatalf("failed to settle transfers: %v", err)
+	}
+
+	after := balances(t, tx, ids)
+	for i, delta := range []int64{-9, 6, 3} {
+		if expected := before[ids[i]].Add(decimal.NewFromInt(delta)); !after[ids[i]].Equal(expected) {
+			t.Fatalf("expected account %d balance %v, got %v", ids[i], expected, after[ids[i]])
+		}
+	}
+
+	totalAfter, err := pgperf.TotalBalance(ctx, tx, "IDRT")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !totalBefore.Equal(totalAfter) {
+		t.Fatalf("total IDRT amount changed (before/after) %v/%v", totalBefore, totalAfter)
+	}
+
+	// Overdraft fails the whole batch.
+	transfers = append(transfers, pgperf.Transfer{From: ids[0], To: ids[1], Amount: after[ids[0]].Add(decimal.NewFromInt(100))})
+	if err := pgperf.SettleBatch(ctx, tx, transfers); err == nil {
+		t.Fatal("expected overdraft error")
+	}
+
+	if failed := balances(t, tx, ids); fmt.Sprint(failed) != fmt.Sprint(after) {
+		t.Fatalf("failed batch changed balances %v -> %v", after, failed)
+	}
+}
+
+func TestSettleBatchCurrencies(t *testing.T) {
+	tx := testTx(t)
+
+	idrt := idrtAccounts(t, tx, 2)
+	btc := currencyAccounts(t, tx, "BTC", decimal.RequireFromString("0.001"), 2)
+
+	// Independent transfers in different currencies are fine.
+	transfers := []pgperf.Transfer{
+		{From: idrt[0], To: idrt[1], Amount: decimal.NewFromInt(1)},
+		{From: btc[0], To: btc[1], Amount: decimal.RequireFromString("0.00000001")},
+	}
+	if err := pgperf.SettleBatch(ctx, tx, transfers); err != nil {
+		t.Fatalf("failed to settle transfers: %v", err)
+	}
+
+	cases := map[string][]pgperf.Transfer{
+		"different currencies": {
+			{From: idrt[0], To: btc[0], Amount: decimal.NewFromInt(1)},
+			{From: btc[1], To: idrt[1], Amount: decimal.NewFromInt(1)},
+		},
+		"too many decimals": {
+			{From: idrt[0], To: idrt[1], Amount: decimal.RequireFromString("0.001")},
+		},
+		"zero amount": {
+			{From: idrt[0], To: idrt[1], Amount: decimal.Zero},
+		},
+	}
+
+	missing := []pgperf.Transfer{{From: idrt[0], To: -1, Amount: decimal.NewFromInt(1)}}
+	if err := pgperf.SettleBatch(ctx, tx, missing); !errors.Is(err, sql.ErrNoRows) || !strings.Contains(err.Error(), "[-1]") {
+		t.Fatalf("expected error naming missing account -1, got %v", err)
+	}
+
+	for name, transfers := range cases {
+		if err := pgperf.SettleBatch(ctx, tx, transfers); err == nil {
+			t.Fatalf("%s: expected error", name)
+		}
+	}
+}
+
+func TestGetBalanceHistory(t *testing.T) {
+	tx := testTx(t)
+
+	const account = 3900001
+	q := `insert into test.transfer_log(from_id, to_id, amount, created_at)
+	      values ($1, 3900002, 5, now() - interval '1 minute'),
+	             (3900002, $1, 20, now() - interval '3 minutes'),
+	             (3900003, $1, 1.5, now() - interval '2 minutes'),
+	             (3900002, 3900003, 100, now())`
+	if _, err := tx.Exec(ctx, q, account); err != nil {
+		t.Fatalf("failed to log transfers: %v", err)
+	}
+
+	history, err := pgperf.GetBalanceHistory(ctx, tx, account)
+	if err != nil {
+		t.Fatalf("failed to get balance history: %v", err)
+	}
+
+	expected := []struct{ delta, balance string }{
+		{"20", "20"},
+		{"1.5", "21.5"},
+		{"-5", "16.5"},
+	}
+
+	if len(history) != len(expected) {
+		t.Fatalf("expected %d rows, got %v", len(expected), history)
+	}
+
+	for i, e := range expected {
+		if history[i].Delta.String() != e.delta || history[i].Balance.String() != e.balance {
+			t.Fatalf("row %d: expected delta %s and balance %s, got %+v", i, e.delta, e.balance, history[i])
+		}
+
+		if i > 0 && history[i].Time.Before(history[i-1].Time) {
+			t.Fatalf("rows are not in chronological order: %v", history)
+		}
+	}
+}
+
+func TestLockAccountsOverlapping(t *testing.T) {
+	requireDB(t)
+
+	ids := idrtAccounts(t, pool, 5)
+
+	// Each worker locks overlapping sets in reversed order, which would deadlock
+	// if rows were locked in the order of ids.
+	sets := [][]int{
+		{ids[4], ids[2], ids[0]},
+		{ids[0], ids[1], ids[2], ids[3]},
+		{ids[3], ids[4], ids[1]},
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(sets)*50)
+	for _, set := range sets {
+		set := set
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < 50; j++ {
+				tx, err := pool.Begin(ctx)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				locked, err := pgperf.LockAccounts(ctx, tx, set)
+				if err == nil && len(locked) != len(set) {
+					err = fmt.Errorf("expected %d locked accounts, got %d", len(set), len(locked))
+				}
+				tx.Rollback(ctx)
+
+				if err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatalf("failed to lock accounts: %v", err)
+	}
+}
+
+func TestTransferLockDryRun(t *testing.T) {
+	tx := testTx(t)
+
+	ids := idrtAccounts(t, tx, 2)
+
+	before := balances(t, tx, ids)
+	dryRun := pgperf.TransferOptions{DryRun: true}
+
+	if _, err := pgperf.TransferLockWithOptions(ctx, tx, ids[0], ids[1], decimal.NewFromInt(10), dryRun); err != nil {
+		t.Fatalf("expected transfer to succeed: %v", err)
+	}
+
+	overdraft := before[ids[0]].Add(decimal.NewFromInt(1))
+	if _, err := pgperf.TransferLockWithOptions(ctx, tx, ids[0], ids[1], overdraft, dryRun); err == nil {
+		t.Fatal("expected overdraft to fail")
+	}
+
+	if after := balances(t, tx, ids); fmt.Sprint(after) != fmt.Sprint(before) {
+		t.Fatalf("dry run changed balances %v -> %v", before, after)
+	}
+}
+
+func TestRunTransfers(t *testing.T) {
+	requireDB(t)
+
+	ids := idrtAccounts(t, pool, 2)
+
+	conn, err := getConn(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	// Transfers cancel each other out, so balances are not changed in the end.
+	transfers := []pgperf.Transfer{
+		{From: ids[0], To: ids[1], Amount: decimal.NewFromInt(5)},
+		{From: ids[1], To: ids[0], Amount: decimal.NewFromInt(5)},
+		{From: ids[0], To: ids[0], Amount: decimal.NewFromInt(1)},
+		{From: ids[1], To: ids[0], Amount: decimal.NewFromInt(2)},
+		{From: ids[0], To: ids[1], Amount: decimal.NewFromInt(2)},
+	}
+
+	var errs []error
+	err = pgperf.AssertConserved(ctx, conn, "IDRT", func() error {
+		errs = pgperf.RunTransfers(ctx, pool, transfers, 2)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, err := range errs {
+		if (err != nil) != (i == 2) {
+			t.Fatalf("expected only self transfer to fail, got %v", errs)
+		}
+	}
+}
+
+func TestTransferLockResult(t *testing.T) {
+	tx := testTx(t)
+
+	ids := idrtAccounts(t, tx, 2)
+
+	before := balances(t, tx, ids)
+	amt := decimal.NewFromInt(7)
+
+	res, err := pgperf.TransferLock(ctx, tx, ids[0], ids[1], amt)
+	if err != nil {
+		t.Fatalf("failed to transfer: %v", err)
+	}
+
+	if !res.FromBalance.Equal(before[ids[0]].Sub(amt)) || !res.ToBalance.Equal(before[ids[1]].Add(amt)) {
+		t.Fatalf("unexpected balances %+v after transfer of %v from %v", res, amt, before)
+	}
+
+	after := balances(t, tx, ids)
+	if !res.FromBalance.Equal(after[ids[0]]) || !res.ToBalance.Equal(after[ids[1]]) {
+		t.Fatalf("returned balances %+v do not match stored %v", res, after)
+	}
+}
+
+func TestGetBalanceForShare(t *testing.T) {
+	reader1 := testTx(t)
+	reader2 := testTx(t)
+	writer := testTx(t)
+
+	var id int
+	if err := reader1.QueryRow(ctx, "select id from test.accounts where currency = 'IDRT' limit 1").Scan(&id); err != nil {
+		t.Fatalf("failed to get IDRT account: %v", err)
+	}
+
+	if _, err := pgperf.GetBalanceForShare(ctx, reader1, id); err != nil {
+		t.Fatalf("failed to get balance: %v", err)
+	}
+
+	// Do not wait forever if lock is not granted.
+	for _, tx := range []pgx.Tx{reader2, writer} {
+		if _, err := tx.Exec(ctx, "set local lock_timeout = '200ms'"); err != nil {
+			t.Fatalf("failed to set lock timeout: %v", err)
+		}
+	}
+
+	if _, err := pgperf.GetBalanceForShare(ctx, reader2, id); err != nil {
+		t.Fatalf("concurrent shared lock is blocked: %v", err)
+	}
+
+	_, err := writer.Exec(ctx, "update test.accounts set amount = amount + 1 where id = $1", id)
+	if err = pgperf.MapError(err); !errors.Is(err, pgperf.ErrLockNotAvailable) {
+		t.Fatalf("expected update to be blocked, got %v", err)
+	}
+}
+
+// testAccounts returns n accounts of user 1 in test currency with amounts that need
+// all numeric digits to be represented exactly.
+func testAccounts(n int) []pgperf.Account {
+	accts := make([]pgperf.Account, n)
+	for i := range accts {
+		amt := decimal.RequireFromString("12345678901234567890.123456789012345678")
+		accts[i] = pgperf.Account{UserID: 1, Currency: "TST", Amount: amt.Add(decimal.NewFromInt(int64(i)))}
+	}
+
+	return accts
+}
+
+func TestInsertAccounts(t *testing.T) {
+	for _, mode := range []pgx.QueryExecMode{pgx.QueryExecModeSimpleProtocol, pgx.QueryExecModeCacheStatement} {
+		t.Run(mode.String(), func(t *testing.T) {
+			tx := testTx(t)
+
+			accts := testAccounts(3)
+			if err := pgperf.InsertAccounts(ctx, tx, accts, mode); err != nil {
+				t.Fatalf("failed to insert accounts: %v", err)
+			}
+
+			var amounts []decimal.Decimal
+			q := "select array_agg(amount order by amount) from test.accounts where currency = 'TST'"
+			if err := tx.QueryRow(ctx, q).Scan(&amounts); err != nil {
+				t.Fatalf("failed to get amounts: %v", err)
+			}
+
+			if len(amounts) != len(accts) {
+				t.Fatalf("expected %d amounts, got %v", len(accts), amounts)
+			}
+
+			for i, a := range accts {
+				if !amounts[i].Equal(a.Amount) {
+					t.Fatalf("amount %v changed to %v", a.Amount, amounts[i])
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkInsertAccounts(b *testing.B) {
+	accts := testAccounts(batchSize)
+	for _, mode := range execModes {
+		b.Run(mode.String(), func(b *testing.B) {
+			conn, err := getConn(ctx)
+			if err != nil {
+				b.Fatalf("failed to aqcuire connection: %v", err)
+			}
+			defer conn.Release()
+
+			for i := 0; i < b.N; i++ {
+				tx, err := conn.Begin(ctx)
+				if err != nil {
+					b.Fatalf("failed to start transaction: %v", err)
+				}
+
+				if err := pgperf.InsertAccounts(ctx, tx, accts, mode); err != nil {
+					tx.Rollback(ctx)
+					b.Fatalf("failed to insert accounts: %v", err)
+				}
+
+				tx.Rollback(ctx)
+			}
+		})
+	}
+}
+
+func TestTransferLockOverflow(t *testing.T) {
+	tx := testTx(t)
+
+	ids := idrtAccounts(t, tx, 2)
+
+	// Largest integer numeric can hold: 131072 nines.
+	if _, err := tx.Exec(ctx, "update test.accounts set amount = repeat('9', 131072)::numeric where id = $1", ids[1]); err != nil {
+		t.Fatalf("failed to set balance: %v", err)
+	}
+
+	if _, err := pgperf.TransferLock(ctx, tx, ids[0], ids[1], decimal.NewFromInt(1)); !errors.Is(err, pgperf.ErrAmountOverflow) {
+		t.Fatalf("expected amount overflow, got %v", err)
+	}
+
+	// Database check in SettleBatch is mapped to the same error.
+	transfers := []pgperf.Transfer{{From: ids[0], To: ids[1], Amount: decimal.NewFromInt(1)}}
+	if err := pgperf.SettleBatch(ctx, tx, transfers); !errors.Is(err, pgperf.ErrAmountOverflow) {
+		t.Fatalf("expected amount overflow from database, got %v", err)
+	}
+}
+
+func TestGetRichAccounts(t *testing.T) {
+	tx := testTx(t)
+
+	ids, err := pgperf.GetRichAccounts(ctx, tx, "IDRT", decimal.NewFromInt(10000000))
+	if err != nil {
+		t.Fatalf("failed to get IDRT accounts: %v", err)
+	}
+
+	if len(ids) == 0 {
+		t.Fatal("expected some rich IDRT accounts")
+	}
+
+	ids, err = pgperf.GetRichAccounts(ctx, tx, "NONE", decimal.Zero)
+	if err != nil {
+		t.Fatalf("failed to get accounts: %v", err)
+	}
+
+	if ids == nil || len(ids) != 0 {
+		t.Fatalf("expected empty non-nil slice, got %#v", ids)
+	}
+}
+
+func TestSettleBatchWithRetry(t *testing.T) {
+	requireDB(t)
+
+	ids := idrtAccounts(t, pool, 3)
+
+	conn, err := getConn(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	// Batches touch the same accounts and cancel each other out.
+	batches := [][]pgperf.Transfer{
+		{{From: ids[0], To: ids[1], Amount: decimal.NewFromInt(3)}, {From: ids[1], To: ids[2], Amount: decimal.NewFromInt(2)}},
+		{{From: ids[2], To: ids[0], Amount: decimal.NewFromInt(2)}, {From: ids[1], To: ids[0], Amount: decimal.NewFromInt(1)}},
+	}
+
+	const workers = 8
+	err = pgperf.AssertConserved(ctx, conn, "IDRT", func() error {
+		var (
+			wg   sync.WaitGroup
+			errs = make(chan error, workers)
+		)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(batch []pgperf.Transfer) {
+				defer wg.Done()
+				errs <- pgperf.SettleBatchWithRetry(ctx, pool, batch, 5)
+			}(batches[i%len(batches)])
+		}
+
+		wg.Wait()
+		close(errs)
+
+		for err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Overdraft is not retried: settle statement is run only once.
+	tracer := &recordingTracer{}
+	p, err := pgperf.NewTunedPool(ctx, connString, pgperf.WithTracer(tracer))
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer p.Close()
+
+	overdraft := []pgperf.Transfer{{From: ids[0], To: ids[1], Amount: decimal.New(1, 18)}}
+	if err := pgperf.SettleBatchWithRetry(ctx, p, overdraft, 5); !errors.Is(err, pgperf.ErrInsufficientFunds) {
+		t.Fatalf("expected ErrInsufficientFunds, got %v", err)
+	}
+
+	if attempts := settleAttempts(tracer); attempts != 1 {
+		t.Fatalf("expected 1 settle attempt, got %d", attempts)
+	}
+}
+
+// settleAttempts returns number of SettleBatch statements recorded by tracer.
+func settleAttempts(tracer *recordingTracer) int {
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+
+	var attempts int
+	for _, s := range tracer.spans {
+		if strings.Contains(s.SQL, "with transfers as") {
+			attempts++
+		}
+	}
+
+	return attempts
+}
+
+func TestSettleBatchWithRetrySerializationFailure(t *testing.T) {
+	requireDB(t)
+
+	// At repeatable read and above, updating a row changed by a transaction that committed
+	// after the snapshot was taken fails with serialization failure.
+	tracer := &recordingTracer{}
+	serializable := func(cfg *pgxpool.Config) {
+		cfg.ConnConfig.RuntimeParams["default_transaction_isolation"] = "serializable"
+	}
+	p, err := pgperf.NewTunedPool(ctx, connString, serializable, pgperf.WithTracer(tracer))
+	if err != nil {
+		t.Fatalf("failed to create pool: %v", err)
+	}
+	defer p.Close()
+
+	ids := idrtAccounts(t, pool, 2)
+
+	holder, err := pool.Begin(ctx)
+	if err != nil {
+		t.Fatalf("failed to start transaction: %v", err)
+	}
+	defer holder.Rollback(ctx)
+
+	before := balances(t, holder, ids)
+
+	if _, err := holder.Exec(ctx, "update test.accounts set amount = amount + 100 where id = $1", ids[0]); err != nil {
+		t.Fatalf("failed to credit account: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		transfers := []pgperf.Transfer{{From: ids[0], To: ids[1], Amount: decimal.NewFromInt(5)}}
+		done <- pgperf.SettleBatchWithRetry(ctx, p, transfers, 3)
+	}()
+
+	// Commit only when the first attempt waits for the holder's row lock,
+	// so it is bound to fail when the lock is released.
+	q := `select count(*) from pg_stat_activity
+	       where wait_event_type = 'Lock' and position('with transfers as' in query) > 0`
+	for i := 0; ; i++ {
+		var waiting int
+		if err := pool.QueryRow(ctx, q).Scan(&waiting); err != nil {
+			t.Fatalf("failed to get waiting queries: %v", err)
+		}
+
+		if waiting > 0 {
+			break
+		}
+
+		if i == 50 {
+			t.Fatal("settlement is not waiting for the lock")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	if err := holder.Commit(ctx); err != nil {
+		t.Fatalf("failed to commit: %v", err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("failed to settle transfers: %v", err)
+	}
+
+	if attempts := settleAttempts(tracer); attempts != 2 {
+		t.Fatalf("expected 2 settle attempts, got %d", attempts)
+	}
+
+	tx := testTx(t)
+	after := balances(t, tx, ids)
+
+	if expected := before[ids[0]].Add(decimal.NewFromInt(95)); !after[ids[0]].Equal(expected) {
+		t.Fatalf("expected source balance %v, got %v", expected, after[ids[0]])
+	}
+
+	if expected := before[ids[1]].Add(decimal.NewFromInt(5)); !after[ids[1]].Equal(expected) {
+		t.Fatalf("expected destination balance %v, got %v", expected, after[ids[1]])
+	}
+
+	// Changes are committed, put balances back.
+	if _, err := pool.Exec(ctx, "update test.accounts set amount = amount - 95 where id = $1", ids[0]); err != nil {
+		t.Fatalf("failed to restore balance: %v", err)
+	}
+
+	if _, err := pool.Exec(ctx, "update test.accounts set amount = amount - 5 where id = $1", ids[1]); err != nil {
+		t.Fatalf("failed to restore balance: %v", err)
+	}
+}
+
+func TestLockAccountsTimeout(t *testing.T) {
+	requireDB(t)
+
+	ids := idrtAccounts(t, pool, 2)
+
+	holder, err := pool.Begin(ctx)
+	if err != nil {
+		t.Fatalf("failed to start transaction: %v", err)
+	}
+	defer holder.Rollback(ctx)
+
+	if _, err := pgperf.LockAccounts(ctx, holder, ids[:1]); err != nil {
+		t.Fatalf("failed to lock account: %v", err)
+	}
+
+	tx := testTx(t)
+
+	start := time.Now()
+	if _, err := pgperf.LockAccountsTimeout(ctx, tx, ids, 100*time.Millisecond); !errors.Is(err, pgperf.ErrLockTimeout) {
+		t.Fatalf("expected ErrLockTimeout, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("lock timeout took %v", elapsed)
+	}
+
+	// Transaction is still usable, and the timeout does not outlive the call.
+	var timeout string
+	if err := tx.QueryRow(ctx, "show lock_timeout").Scan(&timeout); err != nil {
+		t.Fatalf("failed to use transaction after timeout: %v", err)
+	}
+
+	if timeout != "0" {
+		t.Fatalf("expected lock_timeout to be restored, got %q", timeout)
+	}
+
+	if _, err := pgperf.LockAccountsTimeout(ctx, tx, ids[1:], 100*time.Millisecond); err != nil {
+		t.Fatalf("failed to lock free account: %v", err)
+	}
+
+	// Sub-millisecond timeout must not turn into zero, which disables the timeout.
+	if _, err := pgperf.LockAccountsTimeout(ctx, tx, ids, 100*time.Microsecond); !errors.Is(err, pgperf.ErrLockTimeout) {
+		t.Fatalf("expected ErrLockTimeout for sub-millisecond timeout, got %v", err)
+	}
+
+	if _, err := pgperf.LockAccountsTimeout(ctx, tx, ids, 0); err == nil {
+		t.Fatal("expected error for zero timeout")
+	}
+}
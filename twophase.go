@@ -0,0 +1,54 @@
+package pgperf
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/shopspring/decimal"
+)
+
+// quoteLiteral quotes s as SQL string literal. Transaction ids of `prepare transaction`
+// and friends are literals, not expressions, so bind parameters can't be used for them.
+func quoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// PrepareTransfer makes transfer with TransferLock and prepares tx for two-phase commit
+// with global id gid. After that the transaction is not associated with the session
+// anymore: its locks are held and changes are kept (even across server restarts) until
+// CommitPrepared or RollbackPrepared is called, from any session.
+// pgx does not know about it, so tx.Commit must not be called: call tx.Rollback
+// to release tx, it is a no-op on the server (apart from a warning).
+// Requires max_prepared_transactions > 0 on the server.
+func PrepareTransfer(ctx context.Context, tx pgx.Tx, gid string, from, to int, amt decimal.Decimal) error {
+	if _, err := TransferLock(ctx, tx, from, to, amt); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(ctx, "prepare transaction "+quoteLiteral(gid)); err != nil {
+		return MapError(fmt.Errorf("failed to prepare transaction %q: %w", gid, err))
+	}
+
+	return nil
+}
+
+// CommitPrepared commits transaction prepared with gid. It can't run inside a transaction block.
+func CommitPrepared(ctx context.Context, conn *pgxpool.Conn, gid string) error {
+	if _, err := conn.Exec(ctx, "commit prepared "+quoteLiteral(gid)); err != nil {
+		return MapError(fmt.Errorf("failed to commit prepared transaction %q: %w", gid, err))
+	}
+
+	return nil
+}
+
+// RollbackPrepared rolls back transaction prepared with gid. It can't run inside a transaction block.
+func RollbackPrepared(ctx context.Context, conn *pgxpool.Conn, gid string) error {
+	if _, err := conn.Exec(ctx, "rollback prepared "+quoteLiteral(gid)); err != nil {
+		return MapError(fmt.Errorf("failed to rollback prepared transaction %q: %w", gid, err))
+	}
+
+	return nil
+}
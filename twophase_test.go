@@ -0,0 +1,59 @@
+package pgperf_test
+
+import (
+	"testing"
+
+	"pgperf"
+
+	"github.com/shopspring/decimal"
+)
+
+func TestPrepareTransfer(t *testing.T) {
+	requireDB(t)
+
+	conn, err := getConn(ctx)
+	if err != nil {
+		t.Fatalf("failed to acquire connection: %v", err)
+	}
+	defer conn.Release()
+
+	var maxPrepared int
+	if err := conn.QueryRow(ctx, "select current_setting('max_prepared_transactions')::int").Scan(&maxPrepared); err != nil {
+		t.Fatalf("failed to get max_prepared_transactions: %v", err)
+	}
+
+	if maxPrepared == 0 {
+		t.Skip("prepared transactions are disabled")
+	}
+
+	ids := idrtAccounts(t, conn, 2)
+
+	// Transfers there and back keep balances as they were.
+	for i, gid := range []string{"pgperf test 'there'", "pgperf test 'back'"} {
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			t.Fatalf("failed to start transaction: %v", err)
+		}
+
+		err = pgperf.PrepareTransfer(ctx, tx, gid, ids[i], ids[1-i], decimal.NewFromInt(1))
+		tx.Rollback(ctx)
+		if err != nil {
+			t.Fatalf("failed to prepare transfer: %v", err)
+		}
+
+		var prepared bool
+		if err := conn.QueryRow(ctx, "select exists (select from pg_prepared_xacts where gid = $1)", gid).Scan(&prepared); err != nil {
+			t.Fatalf("failed to list prepared transactions: %v", err)
+		}
+
+		if !prepared {
+			pgperf.RollbackPrepared(ctx, conn, gid)
+			t.Fatalf("transaction %q is not prepared", gid)
+		}
+
+		if err := pgperf.CommitPrepared(ctx, conn, gid); err != nil {
+			pgperf.RollbackPrepared(ctx, conn, gid)
+			t.Fatal(err)
+		}
+	}
+}
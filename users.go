@@ -0,0 +1,980 @@
+package pgperf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/shopspring/decimal"
+	"golang.org/x/sync/errgroup"
+)
+
+// User is a row of test.users table.
+type User struct {
+	ID   int
+	Name string
+}
+
+// Insert users letting the database assign ids and get them back with `returning`
+// in the same round trip.
+func InsertUsersReturning(ctx context.Context, tx pgx.Tx, names []string) ([]int, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	var (
+		sb   strings.Builder
+		args = make([]interface{}, 0, len(names))
+	)
+
+	sb.WriteString("insert into test.users(name) values ")
+	for i, name := range names {
+		sb.WriteString(fmt.Sprintf("($%d)", i+1))
+		args = append(args, name)
+		if i < len(names)-1 {
+			sb.WriteRune(',')
+		}
+	}
+	sb.WriteString(" returning id")
+
+	rows, err := tx.Query(ctx, sb.String(), args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to insert users: %w", err)
+	}
+	defer rows.Close()
+
+	ids := make([]int, 0, len(names))
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, fmt.Errorf("failed to scan user id %w", err)
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// StreamUsers runs query returning (id, name) rows and calls fn for each row
+// without accumulating results, so memory usage does not depend on result size.
+// Iteration stops on the first error returned by fn, and this error is returned.
+func StreamUsers(ctx context.Context, tx pgx.Tx, query string, args []interface{}, fn func(User) error) error {
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query users: %w", err)
+	}
+	// Closing rows before all of them are read makes pgx discard the rest of the result,
+	// so the connection is usable again after an early return.
+	defer rows.Close()
+
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Name); err != nil {
+			return fmt.Errorf("failed to scan user %w", err)
+		}
+
+		if err := fn(u); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// UserNamer generates name of a user with given id (see Users.Namer).
+// Nil means DefaultUserName.
+type UserNamer func(id int) string
+
+// name returns name of user id generated by n, or DefaultUserName if n is nil.
+func (n UserNamer) name(id int) string {
+	if n == nil {
+		return DefaultUserName(id)
+	}
+
+	return n(id)
+}
+
+// names returns names of users ids generated by n.
+func (n UserNamer) names(ids []int) []string {
+	names := make([]string, len(ids))
+	for i, id := range ids {
+		names[i] = n.name(id)
+	}
+
+	return names
+}
+
+// DefaultUserName is the `user <id>` name of generated users. Package-level insert helpers
+// always use it, custom names can only be generated with Users.InsertUsers.
+// The numbered InsertUsers1-6 variants inline the same format to keep the benchmarks as they are.
+func DefaultUserName(id int) string {
+	return fmt.Sprintf("user %d", id)
+}
+
+// defaultUserNames returns DefaultUserName names of users ids.
+func defaultUserNames(ids []int) []string {
+	return UserNamer(DefaultUserName).names(ids)
+}
+
+// Users is a users table in a configurable schema.
+// Both names are quoted with pgx.Identifier, so they can safely come from configuration.
+type Users struct {
+	Schema string
+	Table  string
+
+	// Namer generates names of inserted users. Nil means DefaultUserName.
+	Namer UserNamer
+}
+
+// DefaultUsers is the test.users table. Package-level functions (GetUsers1-4, InsertUsers1-6 etc.)
+// do not use it: they have test.users hardcoded in their queries.
+var DefaultUsers = Users{Schema: "test", Table: "users"}
+
+// Identifier returns table identifier, qualified with schema if it is set.
+func (u Users) Identifier() pgx.Identifier {
+	if u.Schema == "" {
+		return pgx.Identifier{u.Table}
+	}
+
+	return pgx.Identifier{u.Schema, u.Table}
+}
+
+// GetUsers returns names of users with given ids (see GetUsers4).
+func (u Users) GetUsers(ctx context.Context, tx pgx.Tx, ids []int) ([]string, error) {
+	names := make([]string, 0, len(ids))
+	rows, err := tx.Query(ctx, "select name from "+u.Identifier().Sanitize()+" where id = any($1)", ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan user name %w", err)
+		}
+
+		names = append(names, name)
+	}
+
+	return names, rows.Err()
+}
+
+// InsertUsers inserts users with given ids named by u.Namer (see InsertUsers6).
+func (u Users) InsertUsers(ctx context.Context, tx pgx.Tx, ids []int) error {
+	rows := make([][]interface{}, len(ids))
+	for i, id := range ids {
+		rows[i] = []interface{}{id, u.Namer.name(id)}
+	}
+
+	cnt, err := tx.CopyFrom(ctx, u.Identifier(), []string{"id", "name"}, pgx.CopyFromRows(rows))
+	if err != nil {
+		return fmt.Errorf("failed to copy users: %w", err)
+	}
+
+	if cnt != int64(len(ids)) {
+		return fmt.Errorf("expected to copy %d rows, but got %d", len(ids), cnt)
+	}
+
+	return nil
+}
+
+// UserAccount is a user joined with one of their accounts.
+type UserAccount struct {
+	UserID   int
+	Name     string
+	Currency string
+	Amount   decimal.Decimal
+}
+
+// StreamUserAccounts streams all users joined with their accounts, calling fn for each row.
+// Iteration stops on the first error returned by fn, and this error is returned.
+func StreamUserAccounts(ctx context.Context, tx pgx.Tx, fn func(UserAccount) error) error {
+	q := `select u.id, u.name, a.currency, a.amount
+	        from test.users u
+	        join test.accounts a on (a.user_id = u.id)`
+
+	rows, err := tx.Query(ctx, q)
+	if err != nil {
+		return fmt.Errorf("failed to query user accounts: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var ua UserAccount
+		if err := rows.Scan(&ua.UserID, &ua.Name, &ua.Currency, &ua.Amount); err != nil {
+			return fmt.Errorf("failed to scan user account: %w", err)
+		}
+
+		if err := fn(ua); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// mergeMinServerVersion is the first PostgreSQL version supporting MERGE (15.0).
+const mergeMinServerVersion = 150000
+
+// ServerVersion returns server version number (e.g. 150002 for 15.2).
+// It is parsed from server_version parameter reported by the server on connect,
+// so no query is made (unless the parameter is missing).
+func ServerVersion(ctx context.Context, tx pgx.Tx) (int, error) {
+	if v, ok := parseServerVersion(tx.Conn().PgConn().ParameterStatus("server_version")); ok {
+		return v, nil
+	}
+
+	var v string
+	if err := tx.QueryRow(ctx, "show server_version_num").Scan(&v); err != nil {
+		return 0, fmt.Errorf("failed to get server version: %w", err)
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse server version %q: %w", v, err)
+	}
+
+	return n, nil
+}
+
+// parseServerVersion converts server_version like "15.2 (Debian 15.2-1.pgdg110+1)", "16beta1"
+// or "9.6.24" into server_version_num format.
+func parseServerVersion(s string) (int, bool) {
+	end := 0
+	for end < len(s) && (s[end] == '.' || s[end] >= '0' && s[end] <= '9') {
+		end++
+	}
+
+	var parts [3]int
+	for i, p := range strings.SplitN(strings.Trim(s[:end], "."), ".", 3) {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return 0, false
+		}
+		parts[i] = n
+	}
+
+	if parts[0] == 0 {
+		return 0, false
+	}
+
+	// Since 10 versions have two parts: 10.1 is 100001.
+	if parts[0] >= 10 {
+		return parts[0]*10000 + parts[1], true
+	}
+
+	return parts[0]*10000 + parts[1]*100 + parts[2], true
+}
+
+// MergeUsers inserts users or updates names of existing ones with MERGE statement
+// (compare with UpsertUsersOnConflict). Requires PostgreSQL 15 or newer,
+// returns ErrUnsupportedServerVersion on older servers.
+func MergeUsers(ctx context.Context, tx pgx.Tx, ids []int) error {
+	v, err := ServerVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	if v < mergeMinServerVersion {
+		return fmt.Errorf("%w: MERGE requires PostgreSQL 15, got %d", ErrUnsupportedServerVersion, v)
+	}
+
+	q := `merge into test.users u
+	      using unnest($1::bigint[], $2::text[]) s(id, name) on (u.id = s.id)
+	      when matched then update set name = s.name
+	      when not matched then insert (id, name) values (s.id, s.name)`
+
+	_, err = tx.Exec(ctx, q, ids, defaultUserNames(ids))
+
+	return MapError(err)
+}
+
+// UpsertUsersOnConflict inserts users or updates names of existing ones with
+// `insert ... on conflict do update`, which works on any supported server (compare with MergeUsers).
+func UpsertUsersOnConflict(ctx context.Context, tx pgx.Tx, ids []int) error {
+	q := `insert into test.users(id, name)
+	      select * from unnest($1::bigint[], $2::text[])
+	      on conflict (id) do update set name = excluded.name`
+
+	_, err := tx.Exec(ctx, q, ids, defaultUserNames(ids))
+
+	return MapError(err)
+}
+
+// getChunkSizes are chunk sizes CalibrateGetChunk tries.
+var getChunkSizes = []int{100, 500, 1000, 5000, 10000}
+
+// calibrationRounds is the number of queries CalibrateGetChunk runs for every chunk size.
+const calibrationRounds = 5
+
+// defaultGetChunk is the chunk size GetUsersChunked uses when given 0.
+const defaultGetChunk = 1000
+
+// GetUsersChunked gets users with GetUsers4 query in chunks of chunkSize ids,
+// so a huge list of ids does not end up in one giant array parameter.
+// Zero chunkSize means a fixed default, a size tuned for the database
+// can be found with CalibrateGetChunk.
+func GetUsersChunked(ctx context.Context, tx pgx.Tx, ids []int, chunkSize int) ([]string, error) {
+	if chunkSize == 0 {
+		chunkSize = defaultGetChunk
+	}
+
+	if chunkSize < 0 {
+		return nil, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+
+	names := make([]string, 0, len(ids))
+	for start := 0; start < len(ids); start += chunkSize {
+		end := start + chunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		chunk, err := GetUsers4(ctx, tx, ids[start:end])
+		if err != nil {
+			return nil, err
+		}
+
+		names = append(names, chunk...)
+	}
+
+	return names, nil
+}
+
+// CalibrateGetChunk measures `= any($1)` query throughput for several chunk sizes against
+// the live database, and returns the one with the most rows per second,
+// to be passed to GetUsersChunked.
+func CalibrateGetChunk(ctx context.Context, pool *pgxpool.Pool) (int, error) {
+	var maxID int
+	if err := pool.QueryRow(ctx, "select coalesce(max(id), 0) from test.users").Scan(&maxID); err != nil {
+		return 0, fmt.Errorf("failed to get max user id: %w", err)
+	}
+
+	if maxID == 0 {
+		return 0, errors.New("users table is empty")
+	}
+
+	best, bestRate := 0, 0.0
+	err := WithTx(ctx, pool, func(tx pgx.Tx) error {
+		for _, size := range getChunkSizes {
+			ids := make([]int, size)
+			var (
+				elapsed time.Duration
+				rows    int
+			)
+			for i := 0; i < calibrationRounds; i++ {
+				for j := range ids {
+					ids[j] = rand.Intn(maxID) + 1
+				}
+
+				start := time.Now()
+				names, err := GetUsers4(ctx, tx, ids)
+				if err != nil {
+					return err
+				}
+				elapsed += time.Since(start)
+				rows += len(names)
+			}
+
+			if rate := float64(rows) / elapsed.Seconds(); rate > bestRate {
+				best, bestRate = size, rate
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to calibrate chunk size: %w", err)
+	}
+
+	return best, nil
+}
+
+// PurgeUsers deletes users and moves them to test.users_archive in a single statement,
+// so there is no window where a user is in both tables or in neither.
+// Returns number of archived users. Users that still have accounts can't be deleted.
+func PurgeUsers(ctx context.Context, tx pgx.Tx, ids []int) (int64, error) {
+	q := `with deleted as (
+	          delete from test.users where id = any($1) returning *
+	      )
+	      insert into test.users_archive select * from deleted`
+
+	r, err := tx.Exec(ctx, q, ids)
+	if err != nil {
+		return 0, MapError(fmt.Errorf("failed to purge users: %w", err))
+	}
+
+	return r.RowsAffected(), nil
+}
+
+// GetUsersCursor iterates over all users with a server-side cursor, fetching batch rows
+// at a time and passing them to fn. Unlike client-side streaming (see StreamUsers),
+// the server keeps the position and the client does not even receive the rest of the rows
+// until it asks for them. Cursors only live inside a transaction.
+func GetUsersCursor(ctx context.Context, tx pgx.Tx, batch int, fn func([]User) error) error {
+	if batch < 1 {
+		return fmt.Errorf("invalid batch size %d", batch)
+	}
+
+	if _, err := tx.Exec(ctx, "declare users_cursor no scroll cursor for select id, name from test.users order by id"); err != nil {
+		return fmt.Errorf("failed to declare cursor: %w", err)
+	}
+	defer tx.Exec(ctx, "close users_cursor")
+
+	fetch := fmt.Sprintf("fetch forward %d from users_cursor", batch)
+	users := make([]User, 0, batch)
+	for {
+		rows, err := tx.Query(ctx, fetch)
+		if err != nil {
+			return fmt.Errorf("failed to fetch users: %w", err)
+		}
+
+		users = users[:0]
+		for rows.Next() {
+			var u User
+			if err := rows.Scan(&u.ID, &u.Name); err != nil {
+				rows.Close()
+				return fmt.Errorf("failed to scan user %w", err)
+			}
+
+			users = append(users, u)
+		}
+
+		if err := rows.Err(); err != nil {
+			return fmt.Errorf("failed to fetch users: %w", err)
+		}
+
+		if len(users) == 0 {
+			return nil
+		}
+
+		if err := fn(users); err != nil {
+			return err
+		}
+	}
+}
+
+// GetUsersForShare reads users locking them with `for share` until the end of transaction.
+// Shared locks do not conflict with each other, so concurrent readers are not blocked,
+// but users can't be updated or deleted until the transaction ends. `for update` would
+// also make concurrent lockers (including other `for share` readers) wait.
+func GetUsersForShare(ctx context.Context, tx pgx.Tx, ids []int) ([]string, error) {
+	rows, err := tx.Query(ctx, "select name from test.users where id = any($1) for share", ids)
+	if err != nil {
+		return nil, MapError(fmt.Errorf("failed to lock users: %w", err))
+	}
+	defer rows.Close()
+
+	names := make([]string, 0, len(ids))
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan user name %w", err)
+		}
+
+		names = append(names, name)
+	}
+
+	return names, MapError(rows.Err())
+}
+
+// InsertUsersUpsertStatus upserts users like UpsertUsersOnConflict, but reports how many of them
+// were inserted and how many updated. xmax of a freshly inserted row version is 0, while
+// a row version written by `on conflict do update` has xmax set to the id of the updating
+// transaction (because the old version is locked before update).
+func InsertUsersUpsertStatus(ctx context.Context, tx pgx.Tx, ids []int) (inserted, updated int, err error) {
+	q := `insert into test.users(id, name)
+	      select * from unnest($1::bigint[], $2::text[])
+	      on conflict (id) do update set name = excluded.name
+	      returning (xmax = 0) as was_inserted`
+
+	rows, err := tx.Query(ctx, q, ids, defaultUserNames(ids))
+	if err != nil {
+		return 0, 0, MapError(fmt.Errorf("failed to upsert users: %w", err))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var wasInserted bool
+		if err := rows.Scan(&wasInserted); err != nil {
+			return 0, 0, fmt.Errorf("failed to scan upsert status: %w", err)
+		}
+
+		if wasInserted {
+			inserted++
+		} else {
+			updated++
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return 0, 0, MapError(fmt.Errorf("failed to upsert users: %w", err))
+	}
+
+	return inserted, updated, nil
+}
+
+// GetUsersTyped reads users by ids. Name column is nullable, and scanning NULL into
+// a string fails, so it is scanned into pgtype.Text and NULL is replaced with nullName.
+func GetUsersTyped(ctx context.Context, tx pgx.Tx, ids []int, nullName string) ([]User, error) {
+	rows, err := tx.Query(ctx, "select id, name from test.users where id = any($1)", ids)
+	if err != nil {
+		return nil, MapError(fmt.Errorf("failed to get users: %w", err))
+	}
+	defer rows.Close()
+
+	users := make([]User, 0, len(ids))
+	for rows.Next() {
+		var (
+			u    User
+			name pgtype.Text
+		)
+
+		if err := rows.Scan(&u.ID, &name); err != nil {
+			return nil, fmt.Errorf("failed to scan user %w", err)
+		}
+
+		u.Name = nullName
+		if name.Valid {
+			u.Name = name.String
+		}
+
+		users = append(users, u)
+	}
+
+	return users, MapError(rows.Err())
+}
+
+// GetUsersWithDeadline runs GetUsers4 with a deadline d instead of `set local statement_timeout`.
+// When the deadline fires, pgx sends a cancel request to the server and closes the connection,
+// so the transaction can't be used anymore. Returns an error wrapping context.DeadlineExceeded.
+func GetUsersWithDeadline(ctx context.Context, tx pgx.Tx, ids []int, d time.Duration) ([]string, error) {
+	ctx, cancel := context.WithTimeout(ctx, d)
+	defer cancel()
+
+	names, err := GetUsers4(ctx, tx, ids)
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return nil, fmt.Errorf("failed to get users in %v: %w", d, ctx.Err())
+	}
+
+	return names, MapError(err)
+}
+
+// GetUsersMode is GetUsers4 with explicit query exec mode, overriding connection default.
+// E.g. QueryExecModeSimpleProtocol does a single round trip, but server parses and plans
+// the query each time, while QueryExecModeCacheStatement reuses a prepared statement.
+func GetUsersMode(ctx context.Context, tx pgx.Tx, ids []int, mode pgx.QueryExecMode) ([]string, error) {
+	rows, err := tx.Query(ctx, "select name from test.users where id = any($1)", mode, ids)
+	if err != nil {
+		return nil, MapError(fmt.Errorf("failed to get users: %w", err))
+	}
+	defer rows.Close()
+
+	names := make([]string, 0, len(ids))
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan user name %w", err)
+		}
+
+		names = append(names, name)
+	}
+
+	return names, MapError(rows.Err())
+}
+
+// GetUsersJSON returns users as a single JSON array of {"id", "name"} objects built on the
+// server side. There is only one value to scan, instead of a row per user, which is handy
+// when JSON is passed straight through to API clients. Returns `[]` if nothing is found.
+func GetUsersJSON(ctx context.Context, tx pgx.Tx, ids []int) (string, error) {
+	q := `select coalesce(json_agg(json_build_object('id', id, 'name', name)), '[]')
+	        from test.users
+	       where id = any($1)`
+
+	var res string
+	if err := tx.QueryRow(ctx, q, ids).Scan(&res); err != nil {
+		return "", MapError(fmt.Errorf("failed to get users: %w", err))
+	}
+
+	return res, nil
+}
+
+// GetUsersParallel reads every chunk of ids (like GetUsers4) on its own connection concurrently.
+// Result has names of i-th chunk at index i. If reading any chunk fails, the context of the
+// others is cancelled, so their queries are cancelled too instead of running to completion.
+func GetUsersParallel(ctx context.Context, pool Acquirer, idChunks [][]int) ([][]string, error) {
+	res := make([][]string, len(idChunks))
+	g, ctx := errgroup.WithContext(ctx)
+	for i, ids := range idChunks {
+		i, ids := i, ids
+		g.Go(func() error {
+			conn, err := pool.Acquire(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to acquire connection: %w", err)
+			}
+			defer conn.Release()
+
+			rows, err := conn.Query(ctx, "select name from test.users where id = any($1)", ids)
+			if err != nil {
+				return fmt.Errorf("failed to get users chunk %d: %w", i, err)
+			}
+
+			names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+			if err != nil {
+				return fmt.Errorf("failed to get users chunk %d: %w", i, err)
+			}
+
+			res[i] = names
+
+			return nil
+		})
+	}
+
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// InsertUsersSkipDup inserts users skipping ids that already exist with
+// `on conflict do nothing`, so re-running the same load does not fail.
+// Returns numbers of inserted and skipped users.
+func InsertUsersSkipDup(ctx context.Context, tx pgx.Tx, ids []int) (inserted, skipped int64, err error) {
+	q := `insert into test.users(id, name)
+	      select * from unnest($1::bigint[], $2::text[])
+	      on conflict (id) do nothing`
+
+	r, err := tx.Exec(ctx, q, ids, defaultUserNames(ids))
+	if err != nil {
+		return 0, 0, MapError(fmt.Errorf("failed to insert users: %w", err))
+	}
+
+	return r.RowsAffected(), int64(len(ids)) - r.RowsAffected(), nil
+}
+
+// GetUsersByRange reads users with lo <= id < hi ordered by id. For contiguous ids a range
+// condition is preferable to `id = any($1)`: it is a single index range scan instead of
+// a lookup per id, and if the table is partitioned by id range, partitions outside of
+// [lo, hi) are pruned (with `= any` of mixed partitions they can't be).
+func GetUsersByRange(ctx context.Context, tx pgx.Tx, lo, hi int) ([]User, error) {
+	rows, err := tx.Query(ctx, "select id, name from test.users where id >= $1 and id < $2 order by id", lo, hi)
+	if err != nil {
+		return nil, MapError(fmt.Errorf("failed to get users: %w", err))
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Name); err != nil {
+			return nil, fmt.Errorf("failed to scan user %w", err)
+		}
+
+		users = append(users, u)
+	}
+
+	return users, MapError(rows.Err())
+}
+
+// InsertUsersSeries inserts users with ids from from to to (inclusive) generated on the server
+// side, so no row data is sent over the wire at all. Names are generated on the server too,
+// in the DefaultUserName format. Returns number of inserted users.
+func InsertUsersSeries(ctx context.Context, tx pgx.Tx, from, to int) (int64, error) {
+	q := "insert into test.users(id, name) select g, 'user ' || g from generate_series($1::bigint, $2::bigint) g"
+
+	r, err := tx.Exec(ctx, q, from, to)
+	if err != nil {
+		return 0, MapError(fmt.Errorf("failed to insert users: %w", err))
+	}
+
+	return r.RowsAffected(), nil
+}
+
+// GetUsersOrdered returns names of users in the order of ids (GetUsers4 does not guarantee
+// any order). Ids that are not found are skipped, the rest keep their relative order.
+func GetUsersOrdered(ctx context.Context, tx pgx.Tx, ids []int) ([]string, error) {
+	q := `select u.name
+	        from unnest($1::bigint[]) with ordinality as k(id, ord)
+	        join test.users u on u.id = k.id
+	       order by k.ord`
+
+	rows, err := tx.Query(ctx, q, ids)
+	if err != nil {
+		return nil, MapError(fmt.Errorf("failed to get users: %w", err))
+	}
+	defer rows.Close()
+
+	names := make([]string, 0, len(ids))
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan user name %w", err)
+		}
+
+		names = append(names, name)
+	}
+
+	return names, MapError(rows.Err())
+}
+
+// GetUsersPage returns a page of users ordered by id together with the total number of users.
+// Total comes with every row from `count(*) over ()`, so there is no separate count query,
+// unless the page is empty: then there are no rows to carry it and users are counted separately.
+func GetUsersPage(ctx context.Context, tx pgx.Tx, offset, limit int) (users []User, total int64, err error) {
+	q := `select id, name, count(*) over ()
+	        from test.users
+	       order by id
+	      offset $1 limit $2`
+
+	rows, err := tx.Query(ctx, q, offset, limit)
+	if err != nil {
+		return nil, 0, MapError(fmt.Errorf("failed to get users page: %w", err))
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Name, &total); err != nil {
+			return nil, 0, fmt.Errorf("failed to scan user %w", err)
+		}
+
+		users = append(users, u)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, 0, MapError(fmt.Errorf("failed to get users page: %w", err))
+	}
+
+	if len(users) == 0 && offset > 0 {
+		if err := tx.QueryRow(ctx, "select count(*) from test.users").Scan(&total); err != nil {
+			return nil, 0, MapError(fmt.Errorf("failed to count users: %w", err))
+		}
+	}
+
+	return users, total, nil
+}
+
+// UserKey is a composite key of a user. test.users has no other columns,
+// so name plays the role of a second key column here.
+type UserKey struct {
+	ID   int
+	Name string
+}
+
+// GetUsersMulti returns users matching any of composite keys. Multi-column lookups can't be
+// expressed with `= any($1)`, so keys are joined as a `values` list built of bind parameters.
+func GetUsersMulti(ctx context.Context, tx pgx.Tx, keys []UserKey) ([]User, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	var sb strings.Builder
+	args := make([]interface{}, 0, len(keys)*2)
+	sb.WriteString("select u.id, u.name from test.users u join (values ")
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteRune(',')
+		}
+		sb.WriteString(fmt.Sprintf("($%d::bigint, $%d::text)", i*2+1, i*2+2))
+		args = append(args, k.ID, k.Name)
+	}
+	sb.WriteString(") k(id, name) on u.id = k.id and u.name = k.name")
+
+	rows, err := tx.Query(ctx, sb.String(), args...)
+	if err != nil {
+		return nil, MapError(fmt.Errorf("failed to get users: %w", err))
+	}
+	defer rows.Close()
+
+	users := make([]User, 0, len(keys))
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Name); err != nil {
+			return nil, fmt.Errorf("failed to scan user %w", err)
+		}
+
+		users = append(users, u)
+	}
+
+	return users, MapError(rows.Err())
+}
+
+// DeleteUsersBatched deletes users by chunks of chunk ids, each in its own committed transaction,
+// so no single long transaction holds row locks on all of them, and autovacuum can clean up
+// dead rows of committed chunks while the rest are still being deleted.
+// It is not atomic: if a chunk fails, previous chunks stay deleted. Returns number of deleted users.
+func DeleteUsersBatched(ctx context.Context, pool *pgxpool.Pool, ids []int, chunk int) (int64, error) {
+	if chunk < 1 {
+		return 0, fmt.Errorf("invalid chunk size %d", chunk)
+	}
+
+	var total int64
+	for start := 0; start < len(ids); start += chunk {
+		end := start + chunk
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		var deleted int64
+		err := WithTx(ctx, pool, func(tx pgx.Tx) error {
+			r, err := tx.Exec(ctx, "delete from test.users where id = any($1)", ids[start:end])
+			if err != nil {
+				return MapError(fmt.Errorf("failed to delete users: %w", err))
+			}
+
+			deleted = r.RowsAffected()
+
+			return nil
+		})
+		if err != nil {
+			return total, err
+		}
+
+		// Counted only after commit, so rows of a chunk that failed to commit are not included.
+		total += deleted
+	}
+
+	return total, nil
+}
+
+// QueryUsers queries id and name of users with given ids and returns rows without scanning
+// them, so callers can use pgx.ForEachRow, pgx.CollectRows or their own scanning.
+// Caller must close the rows (pgx helpers do it).
+func QueryUsers(ctx context.Context, tx pgx.Tx, ids []int) (pgx.Rows, error) {
+	rows, err := tx.Query(ctx, "select id, name from test.users where id = any($1)", ids)
+	if err != nil {
+		return nil, MapError(fmt.Errorf("failed to query users: %w", err))
+	}
+
+	return rows, nil
+}
+
+// UserExists reports whether user with id exists. `exists` stops at the first matching row,
+// unlike count(*) it does not need to visit all of them, and unlike reading the row
+// it does not transfer it.
+func UserExists(ctx context.Context, tx pgx.Tx, id int) (bool, error) {
+	var ok bool
+	if err := tx.QueryRow(ctx, "select exists(select 1 from test.users where id = $1)", id).Scan(&ok); err != nil {
+		return false, MapError(fmt.Errorf("failed to check user %d: %w", id, err))
+	}
+
+	return ok, nil
+}
+
+// likeEscaper escapes LIKE metacharacters, so the string matches only itself.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// SearchUsers returns at most limit users with names starting with prefix, ordered by name.
+// prefix is matched literally: `%` and `_` in it are not wildcards.
+// Prefix `like` can only use an index with text_pattern_ops (see schema.sql).
+func SearchUsers(ctx context.Context, tx pgx.Tx, prefix string, limit int) ([]User, error) {
+	q := `select id, name
+	        from test.users
+	       where name like $1 || '%'
+	       order by name
+	       limit $2`
+
+	rows, err := tx.Query(ctx, q, likeEscaper.Replace(prefix), limit)
+	if err != nil {
+		return nil, MapError(fmt.Errorf("failed to search users: %w", err))
+	}
+	defer rows.Close()
+
+	var users []User
+	for rows.Next() {
+		var u User
+		if err := rows.Scan(&u.ID, &u.Name); err != nil {
+			return nil, fmt.Errorf("failed to scan user %w", err)
+		}
+
+		users = append(users, u)
+	}
+
+	return users, MapError(rows.Err())
+}
+
+// ConflictAction is what InsertUsersResolve does with users that already exist.
+type ConflictAction int
+
+const (
+	// ConflictError fails the insert with ErrUniqueViolation (as InsertUsers1-6 do).
+	ConflictError ConflictAction = iota
+	// ConflictIgnore keeps existing users as they are (see InsertUsersSkipDup).
+	ConflictIgnore
+	// ConflictUpdate overwrites names of existing users (see UpsertUsersOnConflict).
+	ConflictUpdate
+)
+
+func (a ConflictAction) String() string {
+	switch a {
+	case ConflictError:
+		return "error"
+	case ConflictIgnore:
+		return "ignore"
+	case ConflictUpdate:
+		return "update"
+	}
+
+	return fmt.Sprintf("ConflictAction(%d)", int(a))
+}
+
+// InsertUsersResolve inserts users with given ids resolving conflicts
+// with existing users according to onConflict.
+func InsertUsersResolve(ctx context.Context, tx pgx.Tx, ids []int, onConflict ConflictAction) error {
+	q := `insert into test.users(id, name)
+	      select * from unnest($1::bigint[], $2::text[])`
+
+	switch onConflict {
+	case ConflictError:
+	case ConflictIgnore:
+		q += " on conflict (id) do nothing"
+	case ConflictUpdate:
+		q += " on conflict (id) do update set name = excluded.name"
+	default:
+		return fmt.Errorf("unknown conflict action %v", onConflict)
+	}
+
+	if _, err := tx.Exec(ctx, q, ids, defaultUserNames(ids)); err != nil {
+		return MapError(fmt.Errorf("failed to insert users: %w", err))
+	}
+
+	return nil
+}
+
+// UpsertUsers inserts users with given names or renames existing ones.
+// Ids must be unique: Postgres can't update the same row twice in one statement
+// (ON CONFLICT DO UPDATE command cannot affect row a second time), so duplicates
+// are rejected before anything is sent to the server.
+func UpsertUsers(ctx context.Context, tx pgx.Tx, users []User) error {
+	ids := make([]int, len(users))
+	names := make([]string, len(users))
+	seen := make(map[int]struct{}, len(users))
+	for i, u := range users {
+		if _, ok := seen[u.ID]; ok {
+			return fmt.Errorf("duplicate user id %d", u.ID)
+		}
+		seen[u.ID] = struct{}{}
+
+		ids[i], names[i] = u.ID, u.Name
+	}
+
+	q := `insert into test.users(id, name)
+	      select * from unnest($1::bigint[], $2::text[])
+	      on conflict (id) do update set name = excluded.name`
+
+	if _, err := tx.Exec(ctx, q, ids, names); err != nil {
+		return MapError(fmt.Errorf("failed to upsert users: %w", err))
+	}
+
+	return nil
+}
@@ -0,0 +1,1028 @@
+package pgperf_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"pgperf"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/shopspring/decimal"
+)
+
+func TestInsertUsersReturning(t *testing.T) {
+	tx := testTx(t)
+
+	names := make([]string, 10)
+	for i := range names {
+		names[i] = fmt.Sprintf("returning user %d", i)
+	}
+
+	ids, err := pgperf.InsertUsersReturning(ctx, tx, names)
+	if err != nil {
+		t.Fatalf("failed to insert users: %v", err)
+	}
+
+	if len(ids) != len(names) {
+		t.Fatalf("expected %d ids, got %d", len(names), len(ids))
+	}
+}
+
+func TestStreamUsers(t *testing.T) {
+	tx := testTx(t)
+
+	const q = "select id, name from test.users where id = any($1) order by id"
+	ids := []int{1, 2, 3, 4, 5}
+
+	var got []pgperf.User
+	err := pgperf.StreamUsers(ctx, tx, q, []interface{}{ids}, func(u pgperf.User) error {
+		got = append(got, u)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to stream users: %v", err)
+	}
+
+	if len(got) != len(ids) {
+		t.Fatalf("expected %d users, got %d", len(ids), len(got))
+	}
+
+	for i, u := range got {
+		if u.ID != ids[i] || u.Name != fmt.Sprintf("user %d", ids[i]) {
+			t.Fatalf("unexpected user %+v", u)
+		}
+	}
+}
+
+func TestStreamUsersStop(t *testing.T) {
+	tx := testTx(t)
+
+	errStop := errors.New("stop")
+	calls := 0
+	err := pgperf.StreamUsers(ctx, tx, "select id, name from test.users where id <= 100", nil, func(u pgperf.User) error {
+		calls++
+		if calls == 3 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("expected stop error, got %v", err)
+	}
+
+	if calls != 3 {
+		t.Fatalf("expected 3 calls, got %d", calls)
+	}
+
+	// Connection must be usable after early stop.
+	if _, err := pgperf.GetUsers4(ctx, tx, []int{1}); err != nil {
+		t.Fatalf("connection is not usable after stop: %v", err)
+	}
+}
+
+func TestUsersQuotedTable(t *testing.T) {
+	tx := testTx(t)
+
+	users := pgperf.Users{Schema: "test", Table: `users"; drop table test.users; --`}
+	if _, err := tx.Exec(ctx, "create table "+users.Identifier().Sanitize()+" (id bigint primary key, name text)"); err != nil {
+		t.Fatalf("failed to create table: %v", err)
+	}
+
+	if err := users.InsertUsers(ctx, tx, []int{1, 2}); err != nil {
+		t.Fatalf("failed to insert users: %v", err)
+	}
+
+	names, err := users.GetUsers(ctx, tx, []int{1, 2, 3})
+	if err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	if len(names) != 2 {
+		t.Fatalf("expected 2 users, got %v", names)
+	}
+
+	if _, err := pgperf.DefaultUsers.GetUsers(ctx, tx, []int{1}); err != nil {
+		t.Fatalf("test.users is broken: %v", err)
+	}
+}
+
+func TestStreamUserAccounts(t *testing.T) {
+	tx := testTx(t)
+
+	errEnough := errors.New("enough")
+	var got []pgperf.UserAccount
+	err := pgperf.StreamUserAccounts(ctx, tx, func(ua pgperf.UserAccount) error {
+		got = append(got, ua)
+		if len(got) == 20 {
+			return errEnough
+		}
+		return nil
+	})
+	if !errors.Is(err, errEnough) {
+		t.Fatalf("expected stream to stop with callback error, got %v", err)
+	}
+
+	if len(got) != 20 {
+		t.Fatalf("expected 20 rows, got %d", len(got))
+	}
+
+	for _, ua := range got {
+		if ua.Name != fmt.Sprintf("user %d", ua.UserID) {
+			t.Fatalf("unexpected user name in %+v", ua)
+		}
+
+		var amount decimal.Decimal
+		q := "select amount from test.accounts where user_id = $1 and currency = $2"
+		if err := tx.QueryRow(ctx, q, ua.UserID, ua.Currency).Scan(&amount); err != nil {
+			t.Fatalf("failed to get account: %v", err)
+		}
+
+		if !amount.Equal(ua.Amount) {
+			t.Fatalf("expected amount %v, got %v", amount, ua.Amount)
+		}
+	}
+}
+
+func TestMergeUsers(t *testing.T) {
+	tx := testTx(t)
+
+	v, err := pgperf.ServerVersion(ctx, tx)
+	if err != nil {
+		t.Fatalf("failed to get server version: %v", err)
+	}
+
+	var num int
+	if err := tx.QueryRow(ctx, "select current_setting('server_version_num')::int").Scan(&num); err != nil {
+		t.Fatalf("failed to get server version: %v", err)
+	}
+
+	if v != num {
+		t.Fatalf("expected server version %d, got %d", num, v)
+	}
+
+	const newID = 3300001
+	if _, err := tx.Exec(ctx, "update test.users set name = 'renamed' where id = 1"); err != nil {
+		t.Fatalf("failed to rename user: %v", err)
+	}
+
+	err = pgperf.MergeUsers(ctx, tx, []int{1, newID})
+	if v < 150000 {
+		if !errors.Is(err, pgperf.ErrUnsupportedServerVersion) {
+			t.Fatalf("expected unsupported version error, got %v", err)
+		}
+		return
+	}
+
+	if err != nil {
+		t.Fatalf("failed to merge users: %v", err)
+	}
+
+	names, err := pgperf.GetUsers4(ctx, tx, []int{1, newID})
+	if err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	sort.Strings(names)
+	if len(names) != 2 || names[0] != "user 1" || names[1] != fmt.Sprintf("user %d", newID) {
+		t.Fatalf("unexpected users after merge: %v", names)
+	}
+}
+
+func TestCalibrateGetChunk(t *testing.T) {
+	requireDB(t)
+
+	size, err := pgperf.CalibrateGetChunk(ctx, pool)
+	if err != nil {
+		t.Fatalf("failed to calibrate chunk size: %v", err)
+	}
+
+	if size < 100 || size > 10000 {
+		t.Fatalf("chunk size %d is out of bounds", size)
+	}
+
+	tx := testTx(t)
+	for _, chunkSize := range []int{size, 0} {
+		names, err := pgperf.GetUsersChunked(ctx, tx, []int{1, 2, 3}, chunkSize)
+		if err != nil {
+			t.Fatalf("failed to get users: %v", err)
+		}
+
+		if len(names) != 3 {
+			t.Fatalf("expected 3 users, got %v", names)
+		}
+	}
+}
+
+func TestPurgeUsers(t *testing.T) {
+	tx := testTx(t)
+
+	ids := []int{3400001, 3400002, 3400003}
+	if err := pgperf.InsertUsers6(ctx, tx, ids); err != nil {
+		t.Fatalf("failed to insert users: %v", err)
+	}
+
+	n, err := pgperf.PurgeUsers(ctx, tx, append(ids, 3400004))
+	if err != nil {
+		t.Fatalf("failed to purge users: %v", err)
+	}
+
+	if n != int64(len(ids)) {
+		t.Fatalf("expected %d purged users, got %d", len(ids), n)
+	}
+
+	names, err := pgperf.GetUsers4(ctx, tx, ids)
+	if err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	if len(names) != 0 {
+		t.Fatalf("expected purged users to be deleted, got %v", names)
+	}
+
+	archived := pgperf.Users{Schema: "test", Table: "users_archive"}
+	names, err = archived.GetUsers(ctx, tx, ids)
+	if err != nil {
+		t.Fatalf("failed to get archived users: %v", err)
+	}
+
+	if len(names) != len(ids) {
+		t.Fatalf("expected %d archived users, got %v", len(ids), names)
+	}
+}
+
+func TestGetUsersCursor(t *testing.T) {
+	tx := testTx(t)
+
+	var total int
+	if err := tx.QueryRow(ctx, "select count(*) from test.users").Scan(&total); err != nil {
+		t.Fatalf("failed to count users: %v", err)
+	}
+
+	var (
+		n      int
+		lastID int
+	)
+	err := pgperf.GetUsersCursor(ctx, tx, 10000, func(users []pgperf.User) error {
+		for _, u := range users {
+			if u.ID <= lastID {
+				return fmt.Errorf("user %d is delivered out of order or twice", u.ID)
+			}
+			lastID = u.ID
+		}
+		n += len(users)
+
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to iterate users: %v", err)
+	}
+
+	if n != total {
+		t.Fatalf("expected %d users, got %d", total, n)
+	}
+}
+
+func TestGetUsersForShare(t *testing.T) {
+	reader1 := testTx(t)
+	reader2 := testTx(t)
+	writer := testTx(t)
+
+	ids := []int{1, 2}
+	if _, err := pgperf.GetUsersForShare(ctx, reader1, ids); err != nil {
+		t.Fatalf("failed to lock users: %v", err)
+	}
+
+	// Do not wait forever if lock is not granted.
+	for _, tx := range []pgx.Tx{reader2, writer} {
+		if _, err := tx.Exec(ctx, "set local lock_timeout = '200ms'"); err != nil {
+			t.Fatalf("failed to set lock timeout: %v", err)
+		}
+	}
+
+	names, err := pgperf.GetUsersForShare(ctx, reader2, ids)
+	if err != nil {
+		t.Fatalf("concurrent shared lock is blocked: %v", err)
+	}
+
+	if len(names) != len(ids) {
+		t.Fatalf("expected %d users, got %v", len(ids), names)
+	}
+
+	_, err = writer.Exec(ctx, "delete from test.users where id = $1", ids[0])
+	if err = pgperf.MapError(err); !errors.Is(err, pgperf.ErrLockNotAvailable) {
+		t.Fatalf("expected delete to be blocked, got %v", err)
+	}
+}
+
+func TestInsertUsersUpsertStatus(t *testing.T) {
+	tx := testTx(t)
+
+	ids := make([]int, 100)
+	for i := range ids {
+		ids[i] = 3500001 + i
+	}
+
+	// Seed every other user so that half of upserted rows already exist.
+	var seed []int
+	for i := 0; i < len(ids); i += 2 {
+		seed = append(seed, ids[i])
+	}
+
+	if err := pgperf.InsertUsers9(ctx, tx, seed); err != nil {
+		t.Fatalf("failed to seed users: %v", err)
+	}
+
+	inserted, updated, err := pgperf.InsertUsersUpsertStatus(ctx, tx, ids)
+	if err != nil {
+		t.Fatalf("failed to upsert users: %v", err)
+	}
+
+	if inserted != len(ids)-len(seed) || updated != len(seed) {
+		t.Fatalf("expected %d inserted and %d updated, got %d and %d",
+			len(ids)-len(seed), len(seed), inserted, updated)
+	}
+}
+
+func TestGetUsersTypedNullName(t *testing.T) {
+	tx := testTx(t)
+
+	ids := []int{3600001, 3600002}
+	if _, err := tx.Exec(ctx, "insert into test.users(id, name) values ($1, null), ($2, 'named')", ids[0], ids[1]); err != nil {
+		t.Fatalf("failed to insert users: %v", err)
+	}
+
+	users, err := pgperf.GetUsersTyped(ctx, tx, ids, "<null>")
+	if err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	got := map[int]string{}
+	for _, u := range users {
+		got[u.ID] = u.Name
+	}
+
+	if len(got) != 2 || got[ids[0]] != "<null>" || got[ids[1]] != "named" {
+		t.Fatalf("unexpected users %v", users)
+	}
+}
+
+// insertUsersReturning inserts users and gets inserted rows back in the same round trip.
+func insertUsersReturning(tx pgx.Tx, ids []int) ([]pgperf.User, error) {
+	q := `insert into test.users(id, name)
+	      select id, 'user ' || id from unnest($1::bigint[]) id
+	      returning id, name`
+
+	return collectUsers(tx.Query(ctx, q, ids))
+}
+
+// insertUsersThenSelect inserts users and reads them back with a separate query.
+func insertUsersThenSelect(tx pgx.Tx, ids []int) ([]pgperf.User, error) {
+	if err := pgperf.UpsertUsersOnConflict(ctx, tx, ids); err != nil {
+		return nil, err
+	}
+
+	return collectUsers(tx.Query(ctx, "select id, name from test.users where id = any($1)", ids))
+}
+
+func collectUsers(rows pgx.Rows, err error) ([]pgperf.User, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (pgperf.User, error) {
+		var u pgperf.User
+		err := row.Scan(&u.ID, &u.Name)
+		return u, err
+	})
+}
+
+func TestReturningVsSelect(t *testing.T) {
+	ids := []int{3700001, 3700002, 3700003}
+
+	var results [][]pgperf.User
+	for _, f := range []func(pgx.Tx, []int) ([]pgperf.User, error){insertUsersReturning, insertUsersThenSelect} {
+		users, err := f(testTx(t), ids)
+		if err != nil {
+			t.Fatalf("failed to insert users: %v", err)
+		}
+
+		sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+		results = append(results, users)
+	}
+
+	if fmt.Sprint(results[0]) != fmt.Sprint(results[1]) {
+		t.Fatalf("returning got %v, but select got %v", results[0], results[1])
+	}
+}
+
+func BenchmarkReturningVsSelect(b *testing.B) {
+	for _, bc := range []struct {
+		name string
+		f    func(pgx.Tx, []int) ([]pgperf.User, error)
+	}{
+		{"returning", insertUsersReturning},
+		{"select", insertUsersThenSelect},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			runInsertUsersFunc(b, func(ctx context.Context, tx pgx.Tx, ids []int) error {
+				users, err := bc.f(tx, ids)
+				if err == nil && len(users) != len(ids) {
+					err = fmt.Errorf("expected %d users, got %d", len(ids), len(users))
+				}
+
+				return err
+			})
+		})
+	}
+}
+
+func TestGetUsersWithDeadline(t *testing.T) {
+	locker := testTx(t)
+	tx := testTx(t)
+
+	// Make the query slow: it has to wait for the table lock until the deadline.
+	if _, err := locker.Exec(ctx, "lock table test.users in access exclusive mode"); err != nil {
+		t.Fatalf("failed to lock users: %v", err)
+	}
+
+	start := time.Now()
+	_, err := pgperf.GetUsersWithDeadline(ctx, tx, []int{1, 2, 3}, 100*time.Millisecond)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("deadline fired too late: %v", elapsed)
+	}
+
+	// Query is cancelled on the server too, so nobody waits for the lock anymore.
+	q := `select count(*) from pg_locks where not granted and relation = 'test.users'::regclass`
+	for i := 0; ; i++ {
+		var waiting int
+		if err := locker.QueryRow(ctx, q).Scan(&waiting); err != nil {
+			t.Fatalf("failed to get waiting locks: %v", err)
+		}
+
+		if waiting == 0 {
+			break
+		}
+
+		if i == 50 {
+			t.Fatalf("query is still waiting on the server")
+		}
+
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestGetUsersJSON(t *testing.T) {
+	tx := testTx(t)
+
+	res, err := pgperf.GetUsersJSON(ctx, tx, []int{1, 2})
+	if err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	var users []struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	if err := json.Unmarshal([]byte(res), &users); err != nil {
+		t.Fatalf("failed to unmarshal %q: %v", res, err)
+	}
+
+	if len(users) != 2 {
+		t.Fatalf("expected 2 users, got %q", res)
+	}
+
+	res, err = pgperf.GetUsersJSON(ctx, tx, []int{-1})
+	if err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	if res != "[]" {
+		t.Fatalf("expected empty array, got %q", res)
+	}
+}
+
+// failingAcquirer fails n-th acquire, giving out pool connections otherwise.
+type failingAcquirer struct {
+	pool *pgxpool.Pool
+	n    int32
+	cnt  atomic.Int32
+}
+
+var errAcquire = errors.New("induced acquire error")
+
+func (a *failingAcquirer) Acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	if a.cnt.Add(1) == a.n {
+		// Give other chunks time to start their queries.
+		time.Sleep(100 * time.Millisecond)
+		return nil, errAcquire
+	}
+
+	return a.pool.Acquire(ctx)
+}
+
+func TestGetUsersParallel(t *testing.T) {
+	requireDB(t)
+
+	chunks := [][]int{{1, 2}, {3}, {4, 5, 6}}
+	res, err := pgperf.GetUsersParallel(ctx, pool, chunks)
+	if err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	for i, names := range res {
+		if len(names) != len(chunks[i]) {
+			t.Fatalf("expected %d names in chunk %d, got %v", len(chunks[i]), i, names)
+		}
+	}
+}
+
+func TestGetUsersParallelCancel(t *testing.T) {
+	locker := testTx(t)
+
+	// Queries of other chunks block on the lock until they are cancelled.
+	if _, err := locker.Exec(ctx, "lock table test.users in access exclusive mode"); err != nil {
+		t.Fatalf("failed to lock users: %v", err)
+	}
+
+	start := time.Now()
+	a := &failingAcquirer{pool: pool, n: 2}
+	_, err := pgperf.GetUsersParallel(ctx, a, [][]int{{1}, {2}, {3}})
+	if !errors.Is(err, errAcquire) {
+		t.Fatalf("expected induced error, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("other chunks were not cancelled promptly: %v", elapsed)
+	}
+}
+
+func TestInsertUsers5Detailed(t *testing.T) {
+	tx := testTx(t)
+
+	ids := []int{4100001, 4100002, 4100003}
+	if err := pgperf.InsertUsers1(ctx, tx, ids[1:2]); err != nil {
+		t.Fatalf("failed to seed user: %v", err)
+	}
+
+	affected, err := pgperf.InsertUsers5Detailed(ctx, tx, ids)
+	if err != nil {
+		t.Fatalf("failed to insert users: %v", err)
+	}
+
+	if len(affected) != len(ids) {
+		t.Fatalf("expected %d results, got %v", len(ids), affected)
+	}
+
+	if affected[0] != 1 || affected[1] != 0 || affected[2] != 1 {
+		t.Fatalf("expected only existing user to be skipped, got %v", affected)
+	}
+}
+
+func TestInsertUsersSkipDup(t *testing.T) {
+	tx := testTx(t)
+
+	ids := []int{4200001, 4200002, 4200003, 4200004, 4200005}
+	if err := pgperf.InsertUsers9(ctx, tx, ids[:2]); err != nil {
+		t.Fatalf("failed to seed users: %v", err)
+	}
+
+	inserted, skipped, err := pgperf.InsertUsersSkipDup(ctx, tx, ids)
+	if err != nil {
+		t.Fatalf("failed to insert users: %v", err)
+	}
+
+	if inserted != 3 || skipped != 2 {
+		t.Fatalf("expected 3 inserted and 2 skipped, got %d and %d", inserted, skipped)
+	}
+}
+
+func TestGetUsersByRange(t *testing.T) {
+	tx := testTx(t)
+
+	users, err := pgperf.GetUsersByRange(ctx, tx, 10, 15)
+	if err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	if len(users) != 5 || users[0].ID != 10 || users[4].ID != 14 {
+		t.Fatalf("unexpected users %v", users)
+	}
+}
+
+// BenchmarkGetUsersByRange compares reading batchSize users with contiguous ids
+// by a range condition and by `= any`.
+func BenchmarkGetUsersByRange(b *testing.B) {
+	tx, close, err := getTx(ctx)
+	if close != nil {
+		defer close()
+	}
+
+	if err != nil {
+		b.Fatalf("failed to start transaction : %v", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	b.Run("range", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			lo := 1 + rand.Intn(1000000-batchSize)
+			if _, err := pgperf.GetUsersByRange(ctx, tx, lo, lo+batchSize); err != nil {
+				b.Fatalf("failed to get users: %v", err)
+			}
+		}
+	})
+
+	b.Run("any", func(b *testing.B) {
+		ids := make([]int, batchSize)
+		for i := 0; i < b.N; i++ {
+			lo := 1 + rand.Intn(1000000-batchSize)
+			for j := range ids {
+				ids[j] = lo + j
+			}
+
+			if _, err := pgperf.GetUsers4(ctx, tx, ids); err != nil {
+				b.Fatalf("failed to get users: %v", err)
+			}
+		}
+	})
+}
+
+func TestInsertUsersSeries(t *testing.T) {
+	tx := testTx(t)
+
+	n, err := pgperf.InsertUsersSeries(ctx, tx, 4300001, 4300010)
+	if err != nil {
+		t.Fatalf("failed to insert users: %v", err)
+	}
+
+	if n != 10 {
+		t.Fatalf("expected 10 users inserted, got %d", n)
+	}
+
+	names, err := pgperf.GetUsers4(ctx, tx, []int{4300010})
+	if err != nil || len(names) != 1 || names[0] != "user 4300010" {
+		t.Fatalf("unexpected users %v: %v", names, err)
+	}
+}
+
+func TestGetUsersOrdered(t *testing.T) {
+	tx := testTx(t)
+
+	// -1 and -2 do not exist.
+	ids := []int{42, -1, 7, 100500, -2, 3, 7}
+	names, err := pgperf.GetUsersOrdered(ctx, tx, ids)
+	if err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	expected := []string{"user 42", "user 7", "user 100500", "user 3", "user 7"}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, names)
+	}
+}
+
+func TestGetUsersPage(t *testing.T) {
+	tx := testTx(t)
+
+	var expected int64
+	if err := tx.QueryRow(ctx, "select count(*) from test.users").Scan(&expected); err != nil {
+		t.Fatalf("failed to count users: %v", err)
+	}
+
+	for _, c := range []struct {
+		offset, limit, rows int
+	}{
+		{0, 3, 3},
+		{10, 5, 5},
+		{int(expected) - 2, 5, 2},
+		{int(expected) + 10, 5, 0},
+	} {
+		users, total, err := pgperf.GetUsersPage(ctx, tx, c.offset, c.limit)
+		if err != nil {
+			t.Fatalf("failed to get page %d/%d: %v", c.offset, c.limit, err)
+		}
+
+		if len(users) != c.rows || total != expected {
+			t.Fatalf("page %d/%d: expected %d users of %d, got %d of %d",
+				c.offset, c.limit, c.rows, expected, len(users), total)
+		}
+	}
+}
+
+func TestGetUsersMulti(t *testing.T) {
+	tx := testTx(t)
+
+	keys := []pgperf.UserKey{
+		{ID: 1, Name: "user 1"},
+		{ID: 2, Name: "user 3"},
+		{ID: 3, Name: "user 3"},
+		{ID: 4, Name: "'); drop table test.users; --"},
+	}
+
+	users, err := pgperf.GetUsersMulti(ctx, tx, keys)
+	if err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	sort.Slice(users, func(i, j int) bool { return users[i].ID < users[j].ID })
+	expected := []pgperf.User{{ID: 1, Name: "user 1"}, {ID: 3, Name: "user 3"}}
+	if fmt.Sprint(users) != fmt.Sprint(expected) {
+		t.Fatalf("expected %v, got %v", expected, users)
+	}
+}
+
+// seedUsers commits users with ids, so they can be used by functions that manage transactions.
+func seedUsers(tb testing.TB, ids []int) {
+	tb.Helper()
+
+	err := pgperf.WithTx(ctx, pool, func(tx pgx.Tx) error {
+		return pgperf.UpsertUsersOnConflict(ctx, tx, ids)
+	})
+	if err != nil {
+		tb.Fatalf("failed to seed users: %v", err)
+	}
+}
+
+func TestDeleteUsersBatched(t *testing.T) {
+	requireDB(t)
+
+	ids := make([]int, 10)
+	for i := range ids {
+		ids[i] = 4400001 + i
+	}
+
+	seedUsers(t, ids)
+
+	deleted, err := pgperf.DeleteUsersBatched(ctx, pool, append(ids, -1), 3)
+	if err != nil {
+		t.Fatalf("failed to delete users: %v", err)
+	}
+
+	if deleted != int64(len(ids)) {
+		t.Fatalf("expected %d users deleted, got %d", len(ids), deleted)
+	}
+}
+
+func BenchmarkDeleteUsersBatched(b *testing.B) {
+	ids := make([]int, batchSize)
+	for i := range ids {
+		ids[i] = 4400001 + i
+	}
+
+	for _, chunk := range []int{100, batchSize} {
+		b.Run(fmt.Sprintf("chunk-%d", chunk), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				b.StopTimer()
+				seedUsers(b, ids)
+				b.StartTimer()
+
+				if _, err := pgperf.DeleteUsersBatched(ctx, pool, ids, chunk); err != nil {
+					b.Fatalf("failed to delete users: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestQueryUsers(t *testing.T) {
+	tx := testTx(t)
+
+	ids := []int{1, 2, 3}
+	rows, err := pgperf.QueryUsers(ctx, tx, ids)
+	if err != nil {
+		t.Fatalf("failed to query users: %v", err)
+	}
+
+	var (
+		u     pgperf.User
+		names = map[int]string{}
+	)
+	_, err = pgx.ForEachRow(rows, []interface{}{&u.ID, &u.Name}, func() error {
+		names[u.ID] = u.Name
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to read users: %v", err)
+	}
+
+	for _, id := range ids {
+		if names[id] != fmt.Sprintf("user %d", id) {
+			t.Fatalf("unexpected users %v", names)
+		}
+	}
+}
+
+func TestUserExists(t *testing.T) {
+	tx := testTx(t)
+
+	ok, err := pgperf.UserExists(ctx, tx, 1)
+	if err != nil {
+		t.Fatalf("failed to check user: %v", err)
+	}
+
+	if !ok {
+		t.Fatal("expected user 1 to exist")
+	}
+
+	ok, err = pgperf.UserExists(ctx, tx, -1)
+	if err != nil {
+		t.Fatalf("failed to check user: %v", err)
+	}
+
+	if ok {
+		t.Fatal("expected user -1 not to exist")
+	}
+}
+
+// BenchmarkUserExists compares existence check with `exists` and with count(*).
+func BenchmarkUserExists(b *testing.B) {
+	tx, close, err := getTx(ctx)
+	if close != nil {
+		defer close()
+	}
+
+	if err != nil {
+		b.Fatalf("failed to start transaction : %v", err)
+	}
+
+	defer tx.Rollback(ctx)
+
+	b.Run("exists", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := pgperf.UserExists(ctx, tx, rand.Intn(1000000)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("count", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var n int64
+			if err := tx.QueryRow(ctx, "select count(*) from test.users where id = $1", rand.Intn(1000000)).Scan(&n); err != nil {
+				b.Fatalf("failed to count users: %v", err)
+			}
+		}
+	})
+}
+
+func TestUsersNamer(t *testing.T) {
+	tx := testTx(t)
+
+	namer := func(id int) string { return fmt.Sprintf("customer-%d", id) }
+	users := pgperf.DefaultUsers
+	users.Namer = namer
+
+	ids := []int{4700001, 4700002}
+	if err := users.InsertUsers(ctx, tx, ids); err != nil {
+		t.Fatalf("failed to insert users: %v", err)
+	}
+
+	// Nil namer falls back to DefaultUserName.
+	defaultIDs := []int{4700003}
+	if err := pgperf.DefaultUsers.InsertUsers(ctx, tx, defaultIDs); err != nil {
+		t.Fatalf("failed to insert users: %v", err)
+	}
+
+	names, err := pgperf.GetUsersOrdered(ctx, tx, append(ids, defaultIDs...))
+	if err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	expected := []string{namer(ids[0]), namer(ids[1]), pgperf.DefaultUserName(defaultIDs[0])}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Fatalf("expected names %v, got %v", expected, names)
+	}
+}
+
+func TestSearchUsers(t *testing.T) {
+	tx := testTx(t)
+
+	if _, err := tx.Exec(ctx, `insert into test.users(id, name) values
+		(4800001, 'search 50% off'), (4800002, 'search 50 percent'),
+		(4800003, 'search a_b'), (4800004, 'search axb')`); err != nil {
+		t.Fatalf("failed to insert users: %v", err)
+	}
+
+	cases := []struct {
+		prefix   string
+		expected []int
+	}{
+		{"search 50%", []int{4800001}},
+		{"search a_", []int{4800003}},
+		{"search a", []int{4800003, 4800004}},
+	}
+
+	for _, c := range cases {
+		users, err := pgperf.SearchUsers(ctx, tx, c.prefix, 10)
+		if err != nil {
+			t.Fatalf("failed to search users: %v", err)
+		}
+
+		ids := make([]int, len(users))
+		for i, u := range users {
+			ids[i] = u.ID
+		}
+
+		if fmt.Sprint(ids) != fmt.Sprint(c.expected) {
+			t.Fatalf("prefix %q: expected users %v, got %v", c.prefix, c.expected, users)
+		}
+	}
+}
+
+func TestInsertUsersResolve(t *testing.T) {
+	cases := []struct {
+		action   pgperf.ConflictAction
+		err      error
+		expected []string
+	}{
+		{pgperf.ConflictError, pgperf.ErrUniqueViolation, []string{"existing"}},
+		{pgperf.ConflictIgnore, nil, []string{"existing", "user 4900002"}},
+		{pgperf.ConflictUpdate, nil, []string{"user 4900001", "user 4900002"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.action.String(), func(t *testing.T) {
+			tx := testTx(t)
+
+			if _, err := tx.Exec(ctx, "insert into test.users(id, name) values (4900001, 'existing')"); err != nil {
+				t.Fatalf("failed to insert user: %v", err)
+			}
+
+			ids := []int{4900001, 4900002}
+
+			// Failed insert aborts the transaction, so it is done in a savepoint.
+			sp, err := tx.Begin(ctx)
+			if err != nil {
+				t.Fatalf("failed to create savepoint: %v", err)
+			}
+
+			if err := pgperf.InsertUsersResolve(ctx, sp, ids, c.action); !errors.Is(err, c.err) {
+				t.Fatalf("expected error %v, got %v", c.err, err)
+			}
+
+			if c.err != nil {
+				sp.Rollback(ctx)
+			} else if err := sp.Commit(ctx); err != nil {
+				t.Fatalf("failed to release savepoint: %v", err)
+			}
+
+			names, err := pgperf.GetUsersOrdered(ctx, tx, ids)
+			if err != nil {
+				t.Fatalf("failed to get users: %v", err)
+			}
+
+			if fmt.Sprint(names) != fmt.Sprint(c.expected) {
+				t.Fatalf("expected users %q, got %q", c.expected, names)
+			}
+		})
+	}
+}
+
+func TestUpsertUsers(t *testing.T) {
+	tx := testTx(t)
+
+	if _, err := tx.Exec(ctx, "insert into test.users(id, name) values (5000001, 'old')"); err != nil {
+		t.Fatalf("failed to insert user: %v", err)
+	}
+
+	users := []pgperf.User{{ID: 5000001, Name: "renamed"}, {ID: 5000002, Name: "new"}}
+	if err := pgperf.UpsertUsers(ctx, tx, users); err != nil {
+		t.Fatalf("failed to upsert users: %v", err)
+	}
+
+	names, err := pgperf.GetUsersOrdered(ctx, tx, []int{5000001, 5000002})
+	if err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	if fmt.Sprint(names) != "[renamed new]" {
+		t.Fatalf("unexpected users %q", names)
+	}
+
+	// Duplicate id is rejected without touching the database, so tx is still usable.
+	users = []pgperf.User{{ID: 5000001, Name: "first"}, {ID: 5000001, Name: "second"}}
+	if err := pgperf.UpsertUsers(ctx, tx, users); err == nil {
+		t.Fatal("expected duplicate id error")
+	}
+
+	names, err = pgperf.GetUsersOrdered(ctx, tx, []int{5000001})
+	if err != nil {
+		t.Fatalf("failed to get users: %v", err)
+	}
+
+	if fmt.Sprint(names) != "[renamed]" {
+		t.Fatalf("expected user not to change, got %q", names)
+	}
+}